@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RiskAlert struct {
+	UserId    int `json:"-"`
+	Portfolio string
+	Risk      string
+	Param     string
+	Group     string
+	Status    string // "breach" or "recover"
+	Bound     string // "upper" or "lower", the bound violated
+	Limit     float64
+	Value     float64
+	Tm        int64
+}
+
+var pendingAlerts []*RiskAlert
+var pendingAlertsMutex sync.Mutex
+
+func (self *RiskParamDef) violatedBound(v float64) (string, float64) {
+	if !math.IsNaN(self.UpperBound) && v > self.UpperBound {
+		return "upper", self.UpperBound
+	}
+	if !math.IsNaN(self.LowerBound) && v < self.LowerBound {
+		return "lower", self.LowerBound
+	}
+	return "", math.NaN()
+}
+
+func (self *RiskParamDef) HasBounds() bool {
+	return !math.IsNaN(self.UpperBound) || !math.IsNaN(self.LowerBound)
+}
+
+func (self *RiskParamDef) checkBounds(key string, v float64) {
+	if !self.HasBounds() || math.IsNaN(v) {
+		return
+	}
+	bound, limit := self.violatedBound(v)
+	old := self.Breaches[key]
+	if bound == "" && old == nil {
+		return
+	}
+	if old != nil && bound == old.Bound {
+		old.Value = v
+		return
+	}
+	riskDef := self.Parent
+	portfolio := riskDef.Portfolio
+	alert := &RiskAlert{
+		UserId:    portfolio.UserId,
+		Portfolio: portfolio.Name,
+		Risk:      riskDef.DisplayName,
+		Param:     self.Name,
+		Group:     groupOfKey(key),
+		Value:     v,
+		Tm:        time.Now().Unix(),
+	}
+	if bound == "" {
+		alert.Status = "recover"
+		alert.Bound = old.Bound
+		alert.Limit = old.Limit
+		delete(self.Breaches, key)
+	} else {
+		alert.Status = "breach"
+		alert.Bound = bound
+		alert.Limit = limit
+		tmp := *alert
+		self.Breaches[key] = &tmp
+	}
+	log.Printf("risk alert: %d %s/%s/%s/%s %s %s bound %v: %v", alert.UserId, alert.Portfolio, alert.Risk, alert.Param, alert.Group, alert.Status, alert.Bound, alert.Limit, alert.Value)
+	metricAlerts.Add(1, strconv.Itoa(alert.UserId), alert.Portfolio, alert.Status)
+	pendingAlertsMutex.Lock()
+	pendingAlerts = append(pendingAlerts, alert)
+	pendingAlertsMutex.Unlock()
+}
+
+func PublishAlerts() {
+	pendingAlertsMutex.Lock()
+	alerts := pendingAlerts
+	pendingAlerts = nil
+	pendingAlertsMutex.Unlock()
+	for _, alert := range alerts {
+		out, err := json.Marshal([]interface{}{"riskAlert", alert})
+		if err != nil {
+			log.Println("failed to Marshal:", alert)
+			continue
+		}
+		clients.Range(func(_, c interface{}) bool {
+			client := c.(*Client)
+			if client.UserId() == alert.UserId {
+				client.Send(out)
+			}
+			return true
+		})
+	}
+}
+
+// send breaches still active to a newly logged in client
+func PublishActiveAlerts(client *Client) {
+	for _, portfolio := range UserPortfolios[client.UserId()] {
+		for _, riskDef := range portfolio.RiskDefs {
+			for _, rp := range riskDef.Params {
+				rp.mutex.Lock()
+				var alerts [][]byte
+				for _, alert := range rp.Breaches {
+					if out, err := json.Marshal([]interface{}{"riskAlert", alert}); err == nil {
+						alerts = append(alerts, out)
+					}
+				}
+				rp.mutex.Unlock()
+				for _, out := range alerts {
+					client.Send(out)
+				}
+			}
+		}
+	}
+}
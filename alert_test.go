@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCheckBounds(t *testing.T) {
+	cfg, err := ParseIni("[gross]\nformula=sum(Pos*Close)\nupper_bound=100\nlower_bound=-100\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio, err := ParsePortfolio(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := portfolio.RiskDefs[0].Params[0]
+	key := groupStateKey(0, "Tech")
+	pendingAlerts = nil
+	defer func() { pendingAlerts = nil }()
+	tests := []struct {
+		v      float64
+		status string
+		bound  string
+	}{
+		{50, "", ""},
+		{150, "breach", "upper"},
+		{160, "", ""},
+		{90, "recover", "upper"},
+		{120, "breach", "upper"},
+		{-120, "breach", "lower"},
+		{math.NaN(), "", ""},
+		{0, "recover", "lower"},
+	}
+	for i, tt := range tests {
+		pendingAlerts = nil
+		rp.checkBounds(key, tt.v)
+		if tt.status == "" {
+			if len(pendingAlerts) != 0 {
+				t.Errorf("%d: %v: alert %+v, want none", i, tt.v, pendingAlerts[0])
+			}
+			continue
+		}
+		if len(pendingAlerts) != 1 {
+			t.Errorf("%d: %v: %d alerts, want 1", i, tt.v, len(pendingAlerts))
+			continue
+		}
+		alert := pendingAlerts[0]
+		if alert.Status != tt.status || alert.Bound != tt.bound || alert.Group != "Tech" {
+			t.Errorf("%d: %v: alert %+v, want %s %s", i, tt.v, alert, tt.status, tt.bound)
+		}
+		if breach := rp.Breaches[key]; (tt.status == "breach") != (breach != nil) {
+			t.Errorf("%d: %v: active breach %+v", i, tt.v, breach)
+		}
+	}
+	// the active breach follows the value for clients logging in later
+	rp.checkBounds(key, 130)
+	rp.checkBounds(key, 140)
+	if breach := rp.Breaches[key]; breach == nil || breach.Value != 140 || breach.Limit != 100 {
+		t.Errorf("active breach %+v, want value 140 limit 100", breach)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Time allowed for trade server to validate an api user.
+	apiAuthWait = 10 * time.Second
+
+	// Validated api credentials are reused for this long.
+	apiAuthCacheTime = 5 * time.Minute
+)
+
+var chApi = make(chan func())
+var pendingAuths = sync.Map{}
+
+type apiAuth struct {
+	UserId int
+	Tm     time.Time
+}
+
+var apiAuthCache = make(map[[2]string]apiAuth)
+var apiAuthCacheMutex sync.Mutex
+
+// last risk reports published to websocket clients, by user id
+var lastReports map[int]map[string]interface{}
+
+// run fn on the goroutine owning the order book and portfolios
+func onJob(fn func()) bool {
+	done := make(chan bool, 1)
+	select {
+	case chApi <- func() { fn(); done <- true }:
+	case <-time.After(apiAuthWait):
+		return false
+	}
+	<-done
+	return true
+}
+
+// same as websocket login, validated by trade server
+func apiUser(r *http.Request) (int, error) {
+	username, passwd, ok := r.BasicAuth()
+	if !ok {
+		return 0, errors.New("basic auth required")
+	}
+	key := [2]string{username, passwd}
+	apiAuthCacheMutex.Lock()
+	auth, ok := apiAuthCache[key]
+	apiAuthCacheMutex.Unlock()
+	if ok && time.Since(auth.Tm) < apiAuthCacheTime {
+		return auth.UserId, nil
+	}
+	token := atomic.AddInt64(&clientCounter, 1)
+	ch := make(chan int, 1)
+	pendingAuths.Store(token, ch)
+	defer pendingAuths.Delete(token)
+	Request(Array{"validate_user", username, passwd, token})
+	select {
+	case userId := <-ch:
+		if userId <= 0 {
+			return 0, errors.New("invalid username or password")
+		}
+		apiAuthCacheMutex.Lock()
+		apiAuthCache[key] = apiAuth{userId, time.Now()}
+		apiAuthCacheMutex.Unlock()
+		return userId, nil
+	case <-time.After(apiAuthWait):
+		return 0, errors.New("trade server timeout")
+	}
+}
+
+// called on user_validation, returns false if token is not from api
+func ApiUserValidated(token int64, userId int) bool {
+	tmp, _ := pendingAuths.Load(token)
+	if tmp == nil {
+		return false
+	}
+	tmp.(chan int) <- userId
+	return true
+}
+
+func apiError(w http.ResponseWriter, status int, err string) {
+	rd.JSON(w, status, map[string]interface{}{"error": err})
+}
+
+func apiHandler(fn func(w http.ResponseWriter, r *http.Request, p httprouter.Params, userId int)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		userId, err := apiUser(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="openrisk"`)
+			apiError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		fn(w, r, p, userId)
+	}
+}
+
+func apiPortfolios(w http.ResponseWriter, r *http.Request, p httprouter.Params, userId int) {
+	out := []string{}
+	if !onJob(func() {
+		for name := range UserPortfolios[userId] {
+			out = append(out, name)
+		}
+	}) {
+		apiError(w, http.StatusServiceUnavailable, "trade server not connected")
+		return
+	}
+	rd.JSON(w, http.StatusOK, out)
+}
+
+func apiRisk(w http.ResponseWriter, r *http.Request, p httprouter.Params, userId int) {
+	name := p.ByName("portfolio")
+	var portfolio *Portfolio
+	var rpt map[string]interface{}
+	var state *State
+	found := false
+	// only the state is taken on the job goroutine, evaluated off it so that
+	// order and market data handling is not held up
+	if !onJob(func() {
+		portfolio, found = UserPortfolios[userId][name]
+		if !found {
+			return
+		}
+		rpt, _ = lastReports[userId][name].(map[string]interface{})
+		if len(portfolio.missing(rpt)) > 0 {
+			state = CopyState()
+		}
+	}) {
+		apiError(w, http.StatusServiceUnavailable, "trade server not connected")
+		return
+	}
+	if !found {
+		apiError(w, http.StatusNotFound, "portfolio not found: "+name)
+		return
+	}
+	rd.JSON(w, http.StatusOK, portfolio.complete(rpt, state, userId))
+}
+
+// risks not in rpt
+func (p *Portfolio) missing(rpt map[string]interface{}) map[string]bool {
+	out := make(map[string]bool)
+	for _, name := range p.riskNames() {
+		if _, ok := rpt[name]; !ok {
+			out[name] = true
+		}
+	}
+	return out
+}
+
+// rpt of the last evaluation with the risks not evaluated on tick without
+// subscribers added, evaluated on state, a copy taken when missing said so,
+// without side effects
+func (p *Portfolio) complete(rpt map[string]interface{}, state *State, userId int) map[string]interface{} {
+	missing := p.missing(rpt)
+	if len(missing) == 0 || state == nil {
+		if rpt == nil {
+			return map[string]interface{}{}
+		}
+		return rpt
+	}
+	out := p.Peek(p.getPositions(state, state.UserIdAccs[userId]), missing)
+	for name, v := range rpt {
+		out[name] = v
+	}
+	return out
+}
+
+// optional query: from, to, bucket (seconds) for OHLC downsampled series
+func apiHistory(w http.ResponseWriter, r *http.Request, p httprouter.Params, userId int) {
+	q := r.URL.Query()
+	bucket, _ := strconv.ParseFloat(q.Get("bucket"), 64)
+	from, _ := strconv.ParseFloat(q.Get("from"), 64)
+	to, err := strconv.ParseFloat(q.Get("to"), 64)
+	if err != nil || to <= 0 {
+		to = math.Inf(1)
+	}
+	var out interface{}
+	status := http.StatusOK
+	msg := "history not found"
+	if !onJob(func() {
+		portfolio := UserPortfolios[userId][p.ByName("portfolio")]
+		if portfolio == nil {
+			status = http.StatusNotFound
+			return
+		}
+		rp := portfolio.FindParam(p.ByName("risk"), p.ByName("param"))
+		if rp == nil || !rp.Graph {
+			status = http.StatusNotFound
+			return
+		}
+		if q.Get("bucket") != "" && !(bucket >= rp.HistoryResolution && !math.IsInf(bucket, 1)) {
+			status = http.StatusBadRequest
+			msg = "bucket must be a number of seconds not below the history resolution " + strconv.FormatFloat(rp.HistoryResolution, 'f', -1, 64)
+			return
+		}
+		if bucket > 0 {
+			out = rp.DownsampleHistory(from, to, bucket)
+		} else {
+			out = rp.GetHistory(from, to)
+		}
+	}) {
+		apiError(w, http.StatusServiceUnavailable, "trade server not connected")
+		return
+	}
+	if status != http.StatusOK {
+		apiError(w, status, msg)
+		return
+	}
+	rd.JSON(w, status, out)
+}
+
+// optional query: acc, account name, repeatable
+func apiPositions(w http.ResponseWriter, r *http.Request, p httprouter.Params, userId int) {
+	names := r.URL.Query()["acc"]
+	out := []*Position{}
+	if !onJob(func() {
+		for _, acc := range UserIdAccs[userId] {
+			if len(names) > 0 {
+				found := false
+				for _, name := range names {
+					if name == AccNames[acc] {
+						found = true
+						break
+					}
+				}
+				if !found {
+					continue
+				}
+			}
+			for _, pos := range Positions[acc] {
+				tmp := *pos
+				security := *pos.Security
+				tmp.Security = &security
+				out = append(out, &tmp)
+			}
+		}
+	}) {
+		apiError(w, http.StatusServiceUnavailable, "trade server not connected")
+		return
+	}
+	rd.JSON(w, http.StatusOK, out)
+}
+
+// query: acc, account name, security, security id, side, qty, px, optional
+// px defaults to the last price
+func apiPreTrade(w http.ResponseWriter, r *http.Request, p httprouter.Params, userId int) {
+	q := r.URL.Query()
+	securityId, _ := strconv.ParseInt(q.Get("security"), 10, 64)
+	qty, _ := strconv.ParseFloat(q.Get("qty"), 64)
+	px, _ := strconv.ParseFloat(q.Get("px"), 64)
+	var status string
+	var res interface{}
+	if !onJob(func() {
+		for _, acc := range UserIdAccs[userId] {
+			if AccNames[acc] == q.Get("acc") {
+				status, res = preTrade(userId, acc, securityId, q.Get("side"), qty, px)
+				return
+			}
+		}
+		status, res = "error", "account not found: "+q.Get("acc")
+	}) {
+		apiError(w, http.StatusServiceUnavailable, "trade server not connected")
+		return
+	}
+	if status == "error" {
+		apiError(w, http.StatusBadRequest, res.(string))
+		return
+	}
+	rd.JSON(w, http.StatusOK, map[string]interface{}{"status": status, "violations": res})
+}
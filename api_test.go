@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPortfolio = `
+name=test
+[gross]
+group=acc
+formula=sum(Pos*Close*Multiplier)
+incremental=Y
+[pnl]
+[[realized]]
+formula=sum(RealizedPnl)
+window=60
+[[unrealized]]
+formula=sum((Close-AvgPx)*Pos*Multiplier)
+`
+
+// evaluations on the eval goroutine and api reports completed on the job
+// goroutine run concurrently against the same portfolios, run with -race
+func TestEvalAndApiRisk(t *testing.T) {
+	const userId = 1
+	cfg, err := ParseIni(testPortfolio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio, err := ParsePortfolio(cfg, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio.AccPatterns = "*"
+	portfolio.UserId = userId
+	UserPortfolios[userId] = map[string]*Portfolio{portfolio.Name: portfolio}
+	UserIdAccs[userId] = []int{1, 2}
+	AccNames[1] = "A1"
+	AccNames[2] = "A2"
+	for id := int64(1); id <= 3; id++ {
+		s := &Security{Id: id, Multiplier: 1, Rate: 1, MsgRate: 1}
+		s.Close = 10
+		SecurityMapById[id] = s
+		usedSecurities[id] = true
+	}
+	defer func() {
+		delete(UserPortfolios, userId)
+		delete(UserIdAccs, userId)
+		Positions = make(map[int]map[int64]*Position)
+		orders = make(map[int64]*Order)
+	}()
+
+	n := 0
+	trade := func() {
+		n++
+		ord := &Order{
+			Id:       int64(n),
+			St:       "filled",
+			Security: SecurityMapById[int64(n%3+1)],
+			Acc:      n%2 + 1,
+			Qty:      100,
+			Side:     []string{"buy", "sell"}[n%2],
+			LastQty:  100,
+			LastPx:   float64(10 + n%5),
+		}
+		updatePos(ord)
+		ParseMd([]interface{}{"md", []interface{}{float64(n%3 + 1), map[string]interface{}{"c": float64(10 + n%7)}}})
+	}
+	for i := 0; i < 6; i++ {
+		trade()
+	}
+
+	stop := make(chan bool)
+	jobDone := make(chan bool)
+	defer func() {
+		close(stop)
+		<-jobDone
+	}()
+	// job goroutine, as tradeServerJob
+	go func() {
+		defer close(jobDone)
+		chRisk := make(chan map[int]map[string]interface{}, 1)
+		evaluating := false
+		for {
+			select {
+			case <-stop:
+				if evaluating {
+					<-chRisk
+				}
+				return
+			case fn := <-chApi:
+				fn()
+			case rpts := <-chRisk:
+				evaluating = false
+				lastReports = rpts
+			default:
+				trade()
+				if !evaluating {
+					evaluating = true
+					state := TakeState()
+					go func() {
+						chRisk <- RunUserPortfolios(state)
+					}()
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	params := httprouter.Params{{Key: "portfolio", Value: portfolio.Name}}
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		apiRisk(w, httptest.NewRequest("GET", "/api/risk/test", nil), params, userId)
+		if w.Code != http.StatusOK {
+			t.Fatalf("apiRisk status %d: %s", w.Code, w.Body.String())
+		}
+		var rpt map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &rpt); err != nil {
+			t.Fatal(err)
+		}
+		// not subscribed, so evaluated by apiRisk itself
+		for _, name := range []string{"gross", "pnl"} {
+			if _, ok := rpt[name]; !ok {
+				t.Fatalf("%s missing in %s", name, w.Body.String())
+			}
+		}
+	}
+}
+
+// runs api jobs until the test ends, as tradeServerJob does
+func serveApiJobs(t *testing.T) {
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case fn := <-chApi:
+				fn()
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+}
+
+func TestApiHistoryBucket(t *testing.T) {
+	const userId = 2
+	cfg, err := ParseIni("[gross]\nformula=sum(Pos*Close)\ngraph=Y\nhistory_resolution=10\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio, err := ParsePortfolio(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio.Name = "test"
+	UserPortfolios[userId] = map[string]*Portfolio{portfolio.Name: portfolio}
+	defer delete(UserPortfolios, userId)
+	rp := portfolio.RiskDefs[0].Params[0]
+	rp.History[groupStateKey(0, "")] = [][2]float64{{100, 1}, {110, 2}, {125, 3}}
+	serveApiJobs(t)
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, `{"0|":[[100,1],[110,2],[125,3]]}`},
+		{"?bucket=20", http.StatusOK, `{"0|":[[100,1,2,1,2],[120,3,3,3,3]]}`},
+		{"?bucket=Inf", http.StatusBadRequest, ""},
+		{"?bucket=NaN", http.StatusBadRequest, ""},
+		{"?bucket=5", http.StatusBadRequest, ""},
+		{"?bucket=-1", http.StatusBadRequest, ""},
+		{"?bucket=x", http.StatusBadRequest, ""},
+	}
+	params := httprouter.Params{{Key: "portfolio", Value: "test"}, {Key: "risk", Value: "gross"}, {Key: "param", Value: rp.Name}}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		apiHistory(w, httptest.NewRequest("GET", "/api/history/test/gross"+tt.query, nil), params, userId)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.query, w.Code, tt.status, w.Body.String())
+		} else if tt.body != "" && strings.TrimSpace(w.Body.String()) != tt.body {
+			t.Errorf("%s: %s, want %s", tt.query, w.Body.String(), tt.body)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/thoas/go-funk"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var attributesFile = flag.String("attributes", "attributes.csv", "comma separated csv or json files of security reference data, keyed by Symbol, Isin, Sedol, Cusip or Bbgid")
+
+const refDataCheckInterval = 5 * time.Second
+
+// from the least to the most specific, the attributes found by the latter take precedence
+var refDataKeys = []string{"Symbol", "Cusip", "Sedol", "Isin", "Bbgid"}
+
+// custom security attributes, e.g. beta, country, issuer, rating. Replaced as
+// a whole on reload, read only otherwise.
+type RefData struct {
+	ByKey    map[string]map[string]map[string]interface{} // key column -> key -> attribute -> value
+	Defaults map[string]interface{}                       // NaN or "" for securities not found
+	cache    sync.Map                                     // security id -> attribute -> value
+	options  sync.Map                                     // security id -> *OptionContract, nil if not an option
+}
+
+var refData atomic.Value // *RefData
+
+func getRefData() *RefData {
+	tmp, _ := refData.Load().(*RefData)
+	if tmp == nil {
+		return &RefData{}
+	}
+	return tmp
+}
+
+type refRow struct {
+	Key   string // one of refDataKeys
+	Value string
+	Attrs map[string]string
+}
+
+func securityKey(s *Security, key string) string {
+	switch key {
+	case "Symbol":
+		return s.Symbol
+	case "Cusip":
+		return s.Cusip
+	case "Sedol":
+		return s.Sedol
+	case "Isin":
+		return s.Isin
+	case "Bbgid":
+		return s.Bbgid
+	}
+	return ""
+}
+
+// each row is keyed by its most specific non-empty key column
+func newRefRow(values map[string]string) *refRow {
+	row := &refRow{Attrs: make(map[string]string)}
+	for name, v := range values {
+		if funk.ContainsString(refDataKeys, name) {
+			continue
+		}
+		row.Attrs[name] = v
+	}
+	for i := len(refDataKeys) - 1; i >= 0; i-- {
+		if v := values[refDataKeys[i]]; v != "" {
+			row.Key = refDataKeys[i]
+			row.Value = v
+			return row
+		}
+	}
+	return nil
+}
+
+func readRefCsv(data []byte) ([]*refRow, error) {
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	header := records[0]
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+	}
+	var rows []*refRow
+	for _, record := range records[1:] {
+		values := make(map[string]string, len(header))
+		for i, v := range record {
+			if i < len(header) && header[i] != "" {
+				values[header[i]] = strings.TrimSpace(v)
+			}
+		}
+		if row := newRefRow(values); row != nil {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// list of objects, e.g. [{"Isin": "US0378331005", "Beta": 1.2, "Country": "US"}]
+func readRefJson(data []byte) ([]*refRow, error) {
+	var objs []map[string]interface{}
+	if err := json.Unmarshal(data, &objs); err != nil {
+		return nil, err
+	}
+	var rows []*refRow
+	for _, obj := range objs {
+		values := make(map[string]string, len(obj))
+		for name, v := range obj {
+			switch v2 := v.(type) {
+			case string:
+				values[name] = v2
+			case float64:
+				values[name] = strconv.FormatFloat(v2, 'g', -1, 64)
+			}
+		}
+		if row := newRefRow(values); row != nil {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func modTime(fn string) time.Time {
+	stat, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+// files which do not exist are skipped, attributes with only numbers are
+// float64, others string
+func LoadRefData(files string) (*RefData, error) {
+	r := &RefData{
+		ByKey:    make(map[string]map[string]map[string]interface{}),
+		Defaults: make(map[string]interface{}),
+	}
+	var rows []*refRow
+	for _, fn := range split(files, ",") {
+		if fn == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		var tmp []*refRow
+		if strings.ToLower(path.Ext(fn)) == ".json" {
+			tmp, err = readRefJson(data)
+		} else {
+			tmp, err = readRefCsv(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err.Error())
+		}
+		log.Println(len(tmp), "security reference data rows loaded from", fn)
+		rows = append(rows, tmp...)
+	}
+	numeric := make(map[string]bool)
+	for _, row := range rows {
+		for name, v := range row.Attrs {
+			if _, ok := numeric[name]; !ok {
+				numeric[name] = true
+			}
+			if v == "" {
+				continue
+			}
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				numeric[name] = false
+			}
+		}
+	}
+	for name, isNumeric := range numeric {
+		if isNumeric {
+			r.Defaults[name] = math.NaN()
+		} else {
+			r.Defaults[name] = ""
+		}
+	}
+	for _, row := range rows {
+		m := r.ByKey[row.Key]
+		if m == nil {
+			m = make(map[string]map[string]interface{})
+			r.ByKey[row.Key] = m
+		}
+		attrs := m[row.Value]
+		if attrs == nil {
+			attrs = make(map[string]interface{}, len(row.Attrs))
+			m[row.Value] = attrs
+		}
+		for name, v := range row.Attrs {
+			if !numeric[name] {
+				attrs[name] = v
+			} else if v2, err := strconv.ParseFloat(v, 64); err == nil {
+				attrs[name] = v2
+			}
+		}
+	}
+	return r, nil
+}
+
+func modTimes(files string) map[string]time.Time {
+	mtimes := make(map[string]time.Time)
+	for _, fn := range split(files, ",") {
+		if fn != "" {
+			mtimes[fn] = modTime(fn)
+		}
+	}
+	return mtimes
+}
+
+// attributes of s found by any of its keys, without defaults
+func (r *RefData) Attrs(s *Security) map[string]interface{} {
+	if s.Id != 0 {
+		if tmp, ok := r.cache.Load(s.Id); ok {
+			return tmp.(map[string]interface{})
+		}
+	}
+	attrs := make(map[string]interface{})
+	for _, key := range refDataKeys {
+		v := securityKey(s, key)
+		if v == "" {
+			continue
+		}
+		for name, value := range r.ByKey[key][v] {
+			attrs[name] = value
+		}
+	}
+	if s.Id != 0 {
+		r.cache.Store(s.Id, attrs)
+	}
+	return attrs
+}
+
+func setAttributes(params map[string]interface{}, s *Security) {
+	r := getRefData()
+	for name, v := range r.Defaults {
+		params[name] = v
+	}
+	for name, v := range r.Attrs(s) {
+		params[name] = v
+	}
+}
+
+func reloadRefData() {
+	r, err := LoadRefData(*attributesFile)
+	if err != nil {
+		log.Println("failed to load", *attributesFile+":", err)
+		return
+	}
+	refData.Store(r)
+}
+
+// on change of the files, rejected if an attribute used by the expressions of
+// portfolios or scenarios is gone or changed type, e.g. from numbers to strings.
+// False if not applied for trade server not connected, see watchFiles.
+func hotReloadRefData() bool {
+	r, err := LoadRefData(*attributesFile)
+	if err != nil {
+		log.Println("failed to load", *attributesFile+":", err)
+		return true
+	}
+	if !onJob(func() {
+		if err := checkRefData(getRefData(), r, usedVars()); err != nil {
+			log.Println("rejected", *attributesFile+":", err)
+			return
+		}
+		refData.Store(r)
+	}) {
+		log.Println("failed to reload", *attributesFile+": trade server not connected, will retry")
+		return false
+	}
+	return true
+}
+
+func checkRefData(old *RefData, r *RefData, used map[string]bool) error {
+	for name := range used {
+		v0, ok := old.Defaults[name]
+		if !ok {
+			continue
+		}
+		v, ok := r.Defaults[name]
+		if !ok {
+			return fmt.Errorf("attribute %s is used but missing", name)
+		}
+		if reflect.TypeOf(v) != reflect.TypeOf(v0) {
+			return fmt.Errorf("attribute %s is used as %T but now %T", name, v0, v)
+		}
+	}
+	return nil
+}
+
+// variables used by the expressions of all portfolios and scenarios, only on
+// the tradeServerJob goroutine
+func usedVars() map[string]bool {
+	out := make(map[string]bool)
+	for _, portfolios := range UserPortfolios {
+		for _, p := range portfolios {
+			p.vars(out)
+		}
+	}
+	for _, sc := range getScenarios().List {
+		for _, shock := range sc.Shocks {
+			shock.Filter.vars(out)
+		}
+	}
+	return out
+}
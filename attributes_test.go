@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func loadTestRefData(t *testing.T, content string) *RefData {
+	fn := path.Join(t.TempDir(), "attributes.csv")
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRefData(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestCheckRefData(t *testing.T) {
+	old := loadTestRefData(t, "Symbol,Beta,Country\nA,1.2,US\nB,0.8,HK\n")
+	used := map[string]bool{"Beta": true, "Pos": true, "Rating": true}
+	tests := []struct {
+		name    string
+		content string
+		ok      bool
+	}{
+		{"values changed", "Symbol,Beta,Country\nA,1.5,US\n", true},
+		{"unused attribute removed", "Symbol,Beta\nA,1.2\n", true},
+		{"attribute added", "Symbol,Beta,Country,Rating\nA,1.2,US,AA\n", true},
+		{"used attribute removed", "Symbol,Country\nA,US\n", false},
+		{"used attribute retyped", "Symbol,Beta,Country\nA,high,US\n", false},
+	}
+	for _, tt := range tests {
+		err := checkRefData(old, loadTestRefData(t, tt.content), used)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// attributes cached by security id are looked up again when the security is resent
+func TestRefDataResentSecurity(t *testing.T) {
+	saved := getRefData()
+	refData.Store(loadTestRefData(t, "Isin,Country\nISIN1,US\nISIN2,HK\n"))
+	defer refData.Store(saved)
+	defer func() {
+		delete(SecurityMapById, 99)
+		delete(SecurityMapByMarket, "REFTEST")
+		delete(securitiesByCurrency[""], 99)
+	}()
+	msg := func(isin string) []interface{} {
+		return []interface{}{"security", 99., "REF", "REFTEST", "STK", 1., 10., 1., "", 0., 0., "", "", "", "", "", "", "", "", isin}
+	}
+	ParseSecurity(msg("ISIN1"))
+	s := SecurityMapById[99]
+	if v := getRefData().Attrs(s)["Country"]; v != "US" {
+		t.Fatalf("Country %v, want US", v)
+	}
+	ParseSecurity(msg("ISIN2"))
+	if v := getRefData().Attrs(s)["Country"]; v != "HK" {
+		t.Errorf("Country %v after resend, want HK", v)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// one portfolio/risk/param/group value of a risk report, param is empty for
+// risks with a single param, as in RiskDef.Run
+type RiskCell struct {
+	Key   [4]string
+	Value interface{}
+	Json  string
+}
+
+// > and \ in group names are escaped with \, so that the path of nested groups
+// can be split unambiguously
+var groupPathEscaper = strings.NewReplacer(`\`, `\\`, ">", `\>`)
+
+// nested groups are flattened with their path as group, e.g. "acc1>Technology"
+func addCell(cells map[string]*RiskCell, key [4]string, items []interface{}) {
+	parent := key[3]
+	for _, item := range items {
+		tmp, ok := item.([]interface{})
+		if !ok || len(tmp) < 2 {
+			continue
+		}
+		name, _ := tmp[0].(string)
+		name = groupPathEscaper.Replace(name)
+		key[3] = name
+		if parent != "" {
+			key[3] = parent + ">" + name
+		}
+		if len(tmp) > 2 {
+			children, _ := tmp[2].([]interface{})
+			addCell(cells, key, children)
+		}
+		data, err := json.Marshal(tmp[1])
+		if err != nil {
+			log.Println("failed to Marshal:", tmp[1])
+			continue
+		}
+		cells[strings.Join(key[:], "\x00")] = &RiskCell{key, tmp[1], string(data)}
+	}
+}
+
+func FlattenReport(rpt map[string]interface{}) map[string]*RiskCell {
+	cells := make(map[string]*RiskCell)
+	for portfolioName, tmp := range rpt {
+		portfolioRpt, _ := tmp.(map[string]interface{})
+		for riskName, riskRpt := range portfolioRpt {
+			switch v := riskRpt.(type) {
+			case []interface{}:
+				addCell(cells, [4]string{portfolioName, riskName, "", ""}, v)
+			case map[string]interface{}:
+				for paramName, paramRpt := range v {
+					items, _ := paramRpt.([]interface{})
+					addCell(cells, [4]string{portfolioName, riskName, paramName, ""}, items)
+				}
+			}
+		}
+	}
+	return cells
+}
+
+// ["riskDelta", [[portfolio, risk, param, group, value], ...], [[portfolio, risk, param, group], ...]]
+// with changed cells followed by removed ones, nil if nothing changed
+func DiffReport(last map[string]*RiskCell, cells map[string]*RiskCell) []byte {
+	changes := []interface{}{}
+	removals := []interface{}{}
+	for key, cell := range cells {
+		if old := last[key]; old == nil || old.Json != cell.Json {
+			changes = append(changes, []interface{}{cell.Key[0], cell.Key[1], cell.Key[2], cell.Key[3], json.RawMessage(cell.Json)})
+		}
+	}
+	for key, cell := range last {
+		if cells[key] == nil {
+			removals = append(removals, cell.Key[:])
+		}
+	}
+	if len(changes) == 0 && len(removals) == 0 {
+		return nil
+	}
+	out, err := json.Marshal([]interface{}{"riskDelta", changes, removals})
+	if err != nil {
+		log.Println("failed to Marshal risk delta:", err)
+		return nil
+	}
+	return out
+}
+
+func (self *Client) sendFullRisk(rpt map[string]interface{}) {
+	out, err := json.Marshal([]interface{}{"risk", rpt})
+	if err != nil {
+		log.Println("failed to Marshal:", rpt)
+		return
+	}
+	self.Send(out)
+	self.lastFull = time.Now()
+	self.riskPending = false
+}
+
+// full reports skipped by PublishRisk within riskSnapshotInterval, called
+// periodically on the tradeServerJob goroutine with the last reports
+func PublishPendingRisk(rpts map[int]map[string]interface{}) {
+	clients.Range(func(_, c interface{}) bool {
+		client := c.(*Client)
+		if client.riskPending && !client.Delta && time.Since(client.lastFull) >= *riskSnapshotInterval {
+			client.sendFullRisk(client.filterReport(rpts[client.UserId()]))
+		}
+		return true
+	})
+}
+
+// called with each tick's reports on the tradeServerJob goroutine
+func PublishRisk(rpts map[int]map[string]interface{}) {
+	userCells := make(map[int]map[string]*RiskCell)
+	clients.Range(func(_, c interface{}) bool {
+		client := c.(*Client)
+		userId := client.UserId()
+		if !client.Delta && time.Since(client.lastFull) < *riskSnapshotInterval {
+			client.riskPending = true
+			return true
+		}
+		rpt := client.filterReport(rpts[userId])
+		if !client.Delta || client.lastRisk == nil {
+			client.sendFullRisk(rpt)
+			if !client.Delta {
+				return true
+			}
+		}
+		var cells map[string]*RiskCell
+		if client.Subs == nil {
+			cells = userCells[userId]
+			if cells == nil {
+				cells = FlattenReport(rpt)
+				userCells[userId] = cells
+			}
+		} else {
+			cells = FlattenReport(rpt)
+		}
+		if client.lastRisk != nil {
+			if out := DiffReport(client.lastRisk, cells); out != nil {
+				client.Send(out)
+			}
+		}
+		client.lastRisk = cells
+		return true
+	})
+}
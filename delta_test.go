@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffReport(t *testing.T) {
+	last := FlattenReport(map[string]interface{}{
+		"p1": map[string]interface{}{
+			"gross": []interface{}{[]interface{}{"Tech", 100., []interface{}{[]interface{}{"Software", 60.}, []interface{}{"Hardware", 40.}}}},
+			"var":   map[string]interface{}{"95": []interface{}{[]interface{}{"", 10.}}},
+		},
+	})
+	cells := FlattenReport(map[string]interface{}{
+		"p1": map[string]interface{}{
+			"gross": []interface{}{[]interface{}{"Tech", 100., []interface{}{[]interface{}{"Software", 70.}, []interface{}{"A>B", 30.}}}},
+			"var":   map[string]interface{}{"95": []interface{}{[]interface{}{"", 10.}}},
+		},
+	})
+	var msg []json.RawMessage
+	if err := json.Unmarshal(DiffReport(last, cells), &msg); err != nil || len(msg) != 3 {
+		t.Fatalf("invalid risk delta: %v", err)
+	}
+	var changes, removals []string
+	var tmp [][]interface{}
+	json.Unmarshal(msg[1], &tmp)
+	for _, cell := range tmp {
+		changes = append(changes, fmt.Sprintf("%v", cell))
+	}
+	json.Unmarshal(msg[2], &tmp)
+	for _, cell := range tmp {
+		removals = append(removals, fmt.Sprintf("%v", cell))
+	}
+	sort.Strings(changes)
+	want := []string{`[p1 gross  Tech>A\>B 30]`, `[p1 gross  Tech>Software 70]`}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes %v, want %v", changes, want)
+	}
+	if want := []string{`[p1 gross  Tech>Hardware]`}; !reflect.DeepEqual(removals, want) {
+		t.Errorf("removals %v, want %v", removals, want)
+	}
+	if out := DiffReport(cells, cells); out != nil {
+		t.Errorf("%s, want nil for no changes", out)
+	}
+}
+
+// a group named A>B under Tech is not the group B under Tech>A
+func TestFlattenReportEscapesPath(t *testing.T) {
+	cells := FlattenReport(map[string]interface{}{
+		"p1": map[string]interface{}{
+			"gross": []interface{}{
+				[]interface{}{"Tech", 1., []interface{}{[]interface{}{"A>B", 2.}}},
+				[]interface{}{"Tech>A", 3., []interface{}{[]interface{}{"B", 4.}}},
+			},
+		},
+	})
+	var groups []string
+	for _, cell := range cells {
+		groups = append(groups, cell.Key[3])
+	}
+	sort.Strings(groups)
+	if want := []string{`Tech`, `Tech>A\>B`, `Tech\>A`, `Tech\>A>B`}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups %q, want %q", groups, want)
+	}
+}
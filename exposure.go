@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+var betaPy = flag.String("beta_py", "", "python module.function giving Beta of securities not in reference data, called with one position per security, returning [(Symbol, Beta), ...]")
+var deltaPy = flag.String("delta_py", "", "python module.function giving Delta of securities not in reference data, same as beta_py")
+
+// results of beta_py and delta_py by security id as pyEntry, NaN if not
+// given, asked again after refDataCheckInterval and cleared when python is
+// restarted
+var pyBetas sync.Map
+var pyDeltas sync.Map
+
+type pyEntry struct {
+	v     float64
+	asked time.Time
+}
+
+func (s *Security) refValue(name string) (float64, bool) {
+	v, ok := getRefData().Attrs(s)[name].(float64)
+	return v, ok && !math.IsNaN(v)
+}
+
+func pyValue(cache *sync.Map, s *Security) (float64, bool) {
+	tmp, ok := cache.Load(s.Id)
+	if !ok || math.IsNaN(tmp.(pyEntry).v) {
+		return 0, false
+	}
+	return tmp.(pyEntry).v, true
+}
+
+// from reference data, beta_py or 1
+func (s *Security) GetBeta() float64 {
+	if v, ok := s.refValue("Beta"); ok {
+		return v
+	}
+	if v, ok := pyValue(&pyBetas, s); ok {
+		return v
+	}
+	return 1
+}
+
+// from reference data, delta_py, option pricing or 1
+func (s *Security) GetDelta() float64 {
+	if v, ok := s.refValue("Delta"); ok {
+		return v
+	}
+	if v, ok := pyValue(&pyDeltas, s); ok {
+		return v
+	}
+	if g := s.Greeks(); g != nil {
+		return g.Delta
+	}
+	return 1
+}
+
+// notional value in the reporting currency
+func (p *Position) Exposure() float64 {
+	s := p.Security
+	return p.Qty * s.GetClose() * s.Multiplier * s.Rate
+}
+
+// delta-equivalent quantity of the underlying, e.g. shares for stock futures and options
+func (p *Position) DeltaQty() float64 {
+	return p.Qty * p.Security.Multiplier * p.Security.GetDelta()
+}
+
+// delta weighted notional value of the underlying for derivatives, in the reporting currency
+func (p *Position) DeltaExposure() float64 {
+	s := p.Security
+	return p.Qty * s.UnderlyingClose() * s.Multiplier * s.Rate * s.GetDelta()
+}
+
+// call fn for the securities of state not asked within refDataCheckInterval,
+// keeping the values they have until it returns
+func loadPyValues(fn string, cache *sync.Map, state *State) {
+	i := strings.LastIndex(fn, ".")
+	if i <= 0 {
+		return
+	}
+	now := time.Now()
+	var positions []*Position
+	bySymbol := make(map[string][]int64)
+	for _, tmp := range state.Positions {
+		for securityId, p := range tmp {
+			entry := pyEntry{v: math.NaN()}
+			if tmp, ok := cache.Load(securityId); ok {
+				entry = tmp.(pyEntry)
+				if now.Sub(entry.asked) < refDataCheckInterval {
+					continue
+				}
+			}
+			entry.asked = now
+			cache.Store(securityId, entry)
+			positions = append(positions, p)
+			bySymbol[p.Security.Symbol] = append(bySymbol[p.Security.Symbol], securityId)
+		}
+	}
+	if len(positions) == 0 {
+		return
+	}
+	res, err := CallPy(fn[:i], fn[i+1:], "", positions, "")
+	if err != nil {
+		log.Println("failed to call", fn+":", err)
+		return
+	}
+	values := make(map[string]float64)
+	items, _ := res.([]interface{})
+	for _, item := range items {
+		tmp, _ := item.([]interface{})
+		if len(tmp) < 2 {
+			log.Println("invalid item of", fn+":", item)
+			continue
+		}
+		name, ok1 := tmp[0].(string)
+		v, ok2 := tmp[1].(float64)
+		if !ok1 || !ok2 {
+			log.Println("invalid item of", fn+":", item)
+			continue
+		}
+		values[name] = v
+	}
+	for name, securityIds := range bySymbol {
+		v, ok := values[name]
+		if !ok {
+			v = math.NaN()
+		}
+		for _, securityId := range securityIds {
+			cache.Store(securityId, pyEntry{v, now})
+		}
+	}
+}
+
+func LoadPyExposures(state *State) {
+	if *betaPy != "" {
+		loadPyValues(*betaPy, &pyBetas, state)
+	}
+	if *deltaPy != "" {
+		loadPyValues(*deltaPy, &pyDeltas, state)
+	}
+}
+
+func clearPyExposures() {
+	for _, cache := range []*sync.Map{&pyBetas, &pyDeltas} {
+		cache.Range(func(k, _ interface{}) bool {
+			cache.Delete(k)
+			return true
+		})
+	}
+}
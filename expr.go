@@ -11,9 +11,12 @@ import (
 
 type Expression struct {
 	E *govaluate.EvaluableExpression
-	A string    // aggregate function name
-	N int       // for A == "top"
-	C [3]string // for call()
+	A string      // aggregate function name
+	N int         // for A == "top", days for A == "var" or "es"
+	P float64     // confidence in percent for A == "var" or "es"
+	C [3]string   // for call()
+	S string      // scenario name for A == "scenario"
+	X *Expression // aggregate evaluated under the scenario
 }
 
 var predefinedFunctions = map[string]govaluate.ExpressionFunction{
@@ -80,6 +83,7 @@ var predefinedFunctions = map[string]govaluate.ExpressionFunction{
 		a := args[0].(float64)
 		return math.IsInf(a, -1) || math.IsInf(a, 1), nil
 	},
+	"RateTo": rateTo,
 	"strlen": func(args ...interface{}) (interface{}, error) {
 		length := len(args[0].(string))
 		return float64(length), nil
@@ -115,6 +119,61 @@ func ParseExpr(ln string, expr string, name string, params map[string]interface{
 			eres = fmt.Errorf("invalid top expression on line " + ln + ": " + expr + ": missing second parameter")
 			return
 		}
+	} else if strings.HasPrefix(expr, "var(") || strings.HasPrefix(expr, "es(") {
+		// var(confidence, days), es(confidence, days)
+		i := strings.Index(expr, "(")
+		a = expr[:i]
+		fields := split(strings.TrimSuffix(expr[i+1:], ")"), ",")
+		if len(fields) != 2 || !strings.HasSuffix(expr, ")") {
+			eres = fmt.Errorf("invalid " + a + " expression on line " + ln + ": " + expr + ": must be " + a + "(confidence, days)")
+			return
+		}
+		p, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || p <= 0 || p >= 100 {
+			eres = fmt.Errorf("invalid " + a + " expression on line " + ln + ": " + expr + ": confidence must be a percentage between 0 and 100")
+			return
+		}
+		n, err = strconv.Atoi(fields[1])
+		if err != nil || n <= 0 {
+			eres = fmt.Errorf("invalid " + a + " expression on line " + ln + ": " + expr + ": days must be a positive integer")
+			return
+		}
+		res = &Expression{
+			A: a,
+			N: n,
+			P: p,
+		}
+		return
+	} else if strings.HasPrefix(expr, "scenario(") {
+		// scenario(name, aggregate), e.g. scenario(HK -10%, sum(Pos*Close*Multiplier*Rate))
+		var s, aggregate string
+		ok := strings.HasSuffix(expr, ")")
+		if ok {
+			s, aggregate, ok = splitScenarioArgs(expr[len("scenario(") : len(expr)-1])
+		}
+		if !ok {
+			eres = fmt.Errorf("invalid scenario expression on line " + ln + ": " + expr + ": must be scenario(name, aggregate)")
+			return
+		}
+		if getScenarios().ByName[s] == nil {
+			eres = fmt.Errorf("invalid scenario expression on line " + ln + ": " + expr + ": unknown scenario " + s)
+			return
+		}
+		x, err := ParseExpr(ln, aggregate, name, params, valueTmpl, path)
+		if err != nil {
+			eres = err
+			return
+		}
+		if x.A == "" || x.A == "top" || x.A == "call" || x.A == "scenario" {
+			eres = fmt.Errorf("invalid scenario expression on line " + ln + ": " + expr + ": second parameter must be an aggregate, e.g. sum()")
+			return
+		}
+		res = &Expression{
+			A: "scenario",
+			S: s,
+			X: x,
+		}
+		return
 	} else if strings.HasPrefix(expr, "call(") {
 		var m string
 		var f string
@@ -161,6 +220,9 @@ func ParseExpr(ln string, expr string, name string, params map[string]interface{
 		return
 	}
 	e, err := govaluate.NewEvaluableExpressionWithFunctions(expr, predefinedFunctions)
+	if err == nil {
+		e, err = injectFxArgs(e)
+	}
 	if err != nil {
 		eres = fmt.Errorf("invalid " + name + " expression on line " + ln + ": " + expr + ": " + err.Error())
 		return
@@ -184,12 +246,70 @@ func ParseExpr(ln string, expr string, name string, params map[string]interface{
 	return
 }
 
+// the name, optionally quoted, ends at the last comma outside of parentheses
+// and quotes, so that it may contain commas but the aggregate may not
+func splitScenarioArgs(args string) (string, string, bool) {
+	depth := 0
+	var quote byte
+	for i := len(args) - 1; i >= 0; i-- {
+		c := args[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"':
+			quote = c
+		case ')':
+			depth += 1
+		case '(':
+			depth -= 1
+		case ',':
+			if depth == 0 {
+				name := strings.Trim(strings.TrimSpace(args[:i]), "'\"")
+				return name, strings.TrimSpace(args[i+1:]), name != ""
+			}
+		}
+	}
+	return "", "", false
+}
+
+// govaluate functions do not see the parameters, so calls of RateTo(ccy) get
+// the fx rates and currency of the position inserted as their first arguments
+func injectFxArgs(e *govaluate.EvaluableExpression) (*govaluate.EvaluableExpression, error) {
+	tokens := e.Tokens()
+	fn := reflect.ValueOf(rateTo).Pointer()
+	out := make([]govaluate.ExpressionToken, 0, len(tokens))
+	found := false
+	for i, token := range tokens {
+		out = append(out, token)
+		if i == 0 || tokens[i-1].Kind != govaluate.FUNCTION || token.Kind != govaluate.CLAUSE {
+			continue
+		}
+		if f, ok := tokens[i-1].Value.(govaluate.ExpressionFunction); ok && reflect.ValueOf(f).Pointer() == fn {
+			out = append(out,
+				govaluate.ExpressionToken{Kind: govaluate.VARIABLE, Value: fxParam},
+				govaluate.ExpressionToken{Kind: govaluate.SEPARATOR, Value: ","},
+				govaluate.ExpressionToken{Kind: govaluate.VARIABLE, Value: "Currency"},
+				govaluate.ExpressionToken{Kind: govaluate.SEPARATOR, Value: ","})
+			found = true
+		}
+	}
+	if !found {
+		return e, nil
+	}
+	return govaluate.NewEvaluableExpressionFromTokens(out)
+}
+
 func Evaluate(e *Expression, p *Position, optional ...map[string]interface{}) (interface{}, error) {
 	params := make(map[string]interface{}, 60)
 	if len(optional) > 0 && optional[0] != nil {
 		params = optional[0]
 	}
 	s := p.Security
+	setAttributes(params, s)
 	params["Symbol"] = s.Symbol
 	params["Sector"] = s.Sector
 	params["Industry"] = s.Industry
@@ -198,6 +318,7 @@ func Evaluate(e *Expression, p *Position, optional ...map[string]interface{}) (i
 	params["Market"] = s.Market
 	params["Type"] = s.Type
 	params["Currency"] = s.Currency
+	params[fxParam] = s.getFxPairs()
 	params["Multiplier"] = s.Multiplier
 	params["Rate"] = s.Rate
 	params["Adv20"] = s.Adv20
@@ -226,6 +347,34 @@ func Evaluate(e *Expression, p *Position, optional ...map[string]interface{}) (i
 	params["BuyValue"] = p.BuyValue
 	params["SellValue"] = p.SellValue
 	params["Pos0"] = p.Bod.Qty
+	beta := s.GetBeta()
+	params["Beta"] = beta
+	params["Delta"] = s.GetDelta()
+	params["BetaExposure"] = p.Exposure() * beta
+	params["DeltaExposure"] = p.DeltaExposure()
+	params["DeltaQty"] = p.DeltaQty()
+	params["Underlying"] = s.UnderlyingSymbol()
+	params["UnderlyingClose"] = s.UnderlyingClose()
+	var greeks Greeks
+	if g := s.Greeks(); g != nil {
+		greeks = *g
+	}
+	params["Gamma"] = greeks.Gamma
+	params["Vega"] = greeks.Vega
+	params["Theta"] = greeks.Theta
 	params["NaN"] = math.NaN()
 	return e.E.Evaluate(params)
 }
+
+// variables of e, including those of the aggregate evaluated under a scenario
+func (e *Expression) vars(out map[string]bool) {
+	if e == nil {
+		return
+	}
+	if e.E != nil {
+		for _, name := range e.E.Vars() {
+			out[name] = true
+		}
+	}
+	e.X.vars(out)
+}
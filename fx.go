@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var reportingCurrency = flag.String("currency", "", "reporting currency Rate converts into with live fx rates, empty to keep Rate of the security message")
+var fxRatesFile = flag.String("fx_rates", "fx_rates.csv", "csv file of fx rates as pair,rate lines, e.g. USDHKD,7.8, for pairs without FX market data, reloaded on change")
+
+// pair -> rate, e.g. USDHKD -> 7.8 HKD per USD, from fx_rates overridden by
+// close of FX securities, only on the tradeServerJob goroutine
+var fxPairs = make(map[string]float64)
+var fxFilePairs = make(map[string]float64)
+var fxMdPairs = make(map[string]float64)
+
+// copy of fxPairs replaced on every change, for use on any goroutine
+var fxSnapshot atomic.Value // map[string]float64
+
+// fx rates changed since last evaluation, handed over to it by TakeState
+var dirtyFx = false
+
+// dirtyFx is only set if any portfolio depends on fx rates, since it makes
+// every evaluation copy the state
+func publishFxPairs() {
+	tmp := make(map[string]float64, len(fxPairs))
+	for pair, v := range fxPairs {
+		tmp[pair] = v
+	}
+	fxSnapshot.Store(tmp)
+	if !dirtyFx {
+		dirtyFx = anyUsesFx()
+	}
+}
+
+func anyUsesFx() bool {
+	for _, portfolios := range UserPortfolios {
+		for _, p := range portfolios {
+			if p.UsesFx {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getFxPairs() map[string]float64 {
+	tmp, _ := fxSnapshot.Load().(map[string]float64)
+	return tmp
+}
+
+// e.g. USDHKD, USD/HKD, USD.HKD, empty if not a currency pair
+func fxPair(symbol string) string {
+	pair := strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return -1
+	}, symbol)
+	if len(pair) != 6 {
+		return ""
+	}
+	return pair
+}
+
+func LoadFxRates(fn string) (map[string]float64, error) {
+	pairs := make(map[string]float64)
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pairs, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+		pair := fxPair(record[0])
+		v, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if pair == "" || err != nil || v <= 0 {
+			continue
+		}
+		pairs[pair] = v
+	}
+	log.Println(len(pairs), "fx rates loaded from", fn)
+	return pairs, nil
+}
+
+// false if not applied for trade server not connected, see watchFiles
+func reloadFxRates() bool {
+	pairs, err := LoadFxRates(*fxRatesFile)
+	if err != nil {
+		log.Println("failed to load", *fxRatesFile+":", err)
+		return true
+	}
+	return onJob(func() {
+		fxFilePairs = pairs
+		mergeFxPairs()
+	})
+}
+
+func mergeFxPairs() {
+	fxPairs = make(map[string]float64, len(fxFilePairs)+len(fxMdPairs))
+	for pair, v := range fxFilePairs {
+		fxPairs[pair] = v
+	}
+	for pair, v := range fxMdPairs {
+		fxPairs[pair] = v
+	}
+	publishFxPairs()
+	UpdateRates("")
+}
+
+func directFxRate(pairs map[string]float64, from string, to string) (float64, bool) {
+	if v := pairs[from+to]; v > 0 {
+		return v, true
+	}
+	if v := pairs[to+from]; v > 0 {
+		return 1 / v, true
+	}
+	return 0, false
+}
+
+// units of to per unit of from, directly or crossed via USD
+func fxRate(pairs map[string]float64, from string, to string) (float64, bool) {
+	if from == to {
+		return 1, true
+	}
+	if v, ok := directFxRate(pairs, from, to); ok {
+		return v, true
+	}
+	if from != "USD" && to != "USD" {
+		v1, ok1 := directFxRate(pairs, from, "USD")
+		v2, ok2 := directFxRate(pairs, "USD", to)
+		if ok1 && ok2 {
+			return v1 * v2, true
+		}
+	}
+	return 0, false
+}
+
+// Rate of the security message unless the reporting currency is set and
+// its currency converts into it
+func (s *Security) updateRate() {
+	rate := s.MsgRate
+	if *reportingCurrency != "" && s.Currency != "" {
+		if v, ok := fxRate(fxPairs, s.Currency, *reportingCurrency); ok {
+			rate = v
+		}
+	}
+	if rate > 0 && rate != s.Rate {
+		s.Rate = rate
+		if usedSecurities[s.Id] {
+			dirtySecurities[s.Id] = true
+		}
+	}
+}
+
+// parameter of the fx rates an evaluation sees, only accessible to RateTo, see
+// injectFxArgs
+const fxParam = "$fx"
+
+// fx rates of the State copy s was taken with, the live ones otherwise
+func (s *Security) getFxPairs() map[string]float64 {
+	if s.fxPairs != nil {
+		return s.fxPairs
+	}
+	return getFxPairs()
+}
+
+// RateTo(ccy) with the fx rates and currency of the position inserted by
+// injectFxArgs, NaN if no rate is found
+func rateTo(args ...interface{}) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("RateTo expects one currency")
+	}
+	pairs, _ := args[0].(map[string]float64)
+	from, _ := args[1].(string)
+	to, _ := args[2].(string)
+	if v, ok := fxRate(pairs, from, to); ok {
+		return v, nil
+	}
+	return math.NaN(), nil
+}
+
+// copies of positions with Rate converting into currency, NaN if no rate is
+// found, or kept if currency is empty, changed if fx rates changed
+func convertRates(positions []*Position, currency string, pairs map[string]float64, fxChanged bool) []*Position {
+	out := make([]*Position, 0, len(positions))
+	securities := make(map[*Security]*Security)
+	for _, p := range positions {
+		s := securities[p.Security]
+		if s == nil {
+			s2 := *p.Security
+			s = &s2
+			securities[p.Security] = s
+			if currency != "" {
+				if v, ok := fxRate(pairs, s.Currency, currency); ok {
+					s.Rate = v
+				} else {
+					s.Rate = math.NaN()
+				}
+			}
+		}
+		p2 := *p
+		p2.Security = s
+		if fxChanged {
+			p2.changedSeq = p.seq
+		}
+		out = append(out, &p2)
+	}
+	return out
+}
+
+// securities by currency, and the rate into the reporting currency they were
+// last updated with, so that fx changes only touch the currencies affected
+var securitiesByCurrency = make(map[string]map[int64]*Security)
+var currencyRates = make(map[string]float64)
+
+func indexCurrency(s *Security) {
+	tmp := securitiesByCurrency[s.Currency]
+	if tmp == nil {
+		tmp = make(map[int64]*Security)
+		securitiesByCurrency[s.Currency] = tmp
+	}
+	tmp[s.Id] = s
+}
+
+// re-rate the securities of the currencies of pair, or of all currencies if
+// empty or the pair may be crossed via USD. Only the securities of currencies
+// whose rate into the reporting currency changed are touched.
+func UpdateRates(pair string) {
+	currencies := securitiesByCurrency
+	if pair != "" && pair[:3] != "USD" && pair[3:] != "USD" {
+		currencies = make(map[string]map[int64]*Security, 2)
+		for _, ccy := range []string{pair[:3], pair[3:]} {
+			if tmp := securitiesByCurrency[ccy]; tmp != nil {
+				currencies[ccy] = tmp
+			}
+		}
+	}
+	for ccy, securities := range currencies {
+		rate := 0.
+		if *reportingCurrency != "" && ccy != "" {
+			rate, _ = fxRate(fxPairs, ccy, *reportingCurrency)
+		}
+		if v, ok := currencyRates[ccy]; ok && v == rate {
+			continue
+		}
+		currencyRates[ccy] = rate
+		for _, s := range securities {
+			s.updateRate()
+		}
+	}
+}
+
+// subscribed for their close to feed fxPairs, but only used, i.e. marked
+// dirty on ticks, if positions are held in them
+var fxSecurities = make(map[int64]bool)
+
+// currency pairs, subscribed on receipt so that their close feeds fxPairs
+func isFxSecurity(s *Security) bool {
+	return s.Market == "FX" && fxPair(s.Symbol) != ""
+}
+
+// once securities are all received, with previous close of FX securities
+func InitFxRates() {
+	for _, s := range SecurityMapByMarket["FX"] {
+		if close := s.GetClose(); close > 0 && isFxSecurity(s) {
+			fxMdPairs[fxPair(s.Symbol)] = close
+		}
+	}
+	mergeFxPairs()
+}
+
+// on close of FX securities
+func onFxTick(s *Security) {
+	pair := fxPair(s.Symbol)
+	close := s.GetClose()
+	if close <= 0 || fxMdPairs[pair] == close {
+		return
+	}
+	fxMdPairs[pair] = close
+	fxPairs[pair] = close
+	publishFxPairs()
+	if *reportingCurrency != "" {
+		UpdateRates(pair)
+	}
+}
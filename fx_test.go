@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFxRate(t *testing.T) {
+	pairs := map[string]float64{"USDHKD": 7.8, "EURUSD": 1.1, "GBPUSD": 1.25}
+	tests := []struct {
+		from, to string
+		want     float64
+		ok       bool
+	}{
+		{"HKD", "HKD", 1, true},
+		{"USD", "HKD", 7.8, true},
+		{"HKD", "USD", 1 / 7.8, true},
+		{"EUR", "HKD", 1.1 * 7.8, true},
+		{"HKD", "EUR", 1 / 7.8 / 1.1, true},
+		{"EUR", "GBP", 1.1 / 1.25, true},
+		{"JPY", "HKD", 0, false},
+		{"EUR", "JPY", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := fxRate(pairs, tt.from, tt.to)
+		if ok != tt.ok || !floatEqual(got, tt.want) {
+			t.Errorf("fxRate(%s, %s) = %v, %v, want %v, %v", tt.from, tt.to, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestConvertRates(t *testing.T) {
+	pairs := map[string]float64{"USDHKD": 7.8, "EURUSD": 1.1}
+	hkd := &Security{Id: 1, Currency: "HKD", Rate: 1}
+	eur := &Security{Id: 2, Currency: "EUR", Rate: 1}
+	jpy := &Security{Id: 3, Currency: "JPY", Rate: 1}
+	var positions []*Position
+	for _, s := range []*Security{hkd, hkd, eur, jpy} {
+		p := &Position{Security: s}
+		p.seq = 2
+		p.changedSeq = 1
+		positions = append(positions, p)
+	}
+	got := convertRates(positions, "USD", pairs, true)
+	want := []float64{1 / 7.8, 1 / 7.8, 1.1, math.NaN()}
+	for i, p := range got {
+		if !floatEqual(p.Security.Rate, want[i]) {
+			t.Errorf("position %d: Rate %v, want %v", i, p.Security.Rate, want[i])
+		}
+		if p.changedSeq != 2 {
+			t.Errorf("position %d: changedSeq %v, want 2 for fx changed", i, p.changedSeq)
+		}
+	}
+	// converted once per security, the originals are left alone
+	if got[0].Security != got[1].Security || hkd.Rate != 1 || positions[0].changedSeq != 1 {
+		t.Error("security not shared or original modified")
+	}
+	got = convertRates(positions, "", pairs, false)
+	if got[3].Security.Rate != 1 || got[3].changedSeq != 1 {
+		t.Errorf("Rate %v changedSeq %v, want kept without currency", got[3].Security.Rate, got[3].changedSeq)
+	}
+}
+
+// an EURHKD tick only re-rates EUR and HKD securities, and the FX security
+// itself is not marked dirty unless used
+func TestFxTick(t *testing.T) {
+	savedCcy := *reportingCurrency
+	*reportingCurrency = "HKD"
+	savedPairs, savedMdPairs, savedRates := fxPairs, fxMdPairs, currencyRates
+	savedByCurrency := securitiesByCurrency
+	defer func() {
+		*reportingCurrency = savedCcy
+		fxPairs, fxMdPairs, currencyRates = savedPairs, savedMdPairs, savedRates
+		securitiesByCurrency = savedByCurrency
+		dirtySecurities = make(map[int64]bool)
+		dirtyFx = false
+		publishFxPairs()
+	}()
+	fxPairs = map[string]float64{"EURHKD": 8.5, "USDHKD": 7.8, "GBPHKD": 10}
+	fxMdPairs = map[string]float64{}
+	currencyRates = map[string]float64{}
+	securitiesByCurrency = map[string]map[int64]*Security{}
+	var securities []*Security
+	for i, ccy := range []string{"EUR", "GBP", "USD"} {
+		s := &Security{Id: int64(9001 + i), Currency: ccy}
+		indexCurrency(s)
+		securities = append(securities, s)
+		usedSecurities[s.Id] = true
+		defer delete(usedSecurities, s.Id)
+	}
+	fx := &Security{Id: 9009, Symbol: "EUR/HKD", Market: "FX"}
+	fx.Close = 8.6
+	UpdateRates("")
+	dirtySecurities = make(map[int64]bool)
+	onFxTick(fx)
+	if securities[0].Rate != 8.6 || securities[1].Rate != 10 || securities[2].Rate != 7.8 {
+		t.Errorf("rates %v %v %v, want 8.6 10 7.8", securities[0].Rate, securities[1].Rate, securities[2].Rate)
+	}
+	if len(dirtySecurities) != 1 || !dirtySecurities[securities[0].Id] {
+		t.Errorf("dirty securities %v, want only %v", dirtySecurities, securities[0].Id)
+	}
+	if usedSecurities[fx.Id] {
+		t.Error("FX security used")
+	}
+}
+
+func TestRateTo(t *testing.T) {
+	e, err := ParseExpr("1", "Pos*Close*RateTo('EUR')", "formula", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := map[string]float64{"EURGBP": 0.8, "USDHKD": 8, "EURUSD": 1.25}
+	tests := []struct {
+		currency string
+		want     float64
+	}{
+		{"EUR", 1000},
+		{"GBP", 1250},
+		{"HKD", 100},
+		{"JPY", math.NaN()},
+	}
+	for _, tt := range tests {
+		s := &Security{Currency: tt.currency, fxPairs: pairs}
+		s.Close = 10
+		p := &Position{Security: s}
+		p.Qty = 100
+		v, err := Evaluate(e, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := v.(float64); !floatEqual(got, tt.want) {
+			t.Errorf("RateTo('EUR') of %s position = %v, want %v", tt.currency, v, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var historyFlushInterval = flag.Duration("history_flush_interval", time.Minute, "interval of writing history points to files, 0 to only write them on exit and reparse")
+
+// one append-only file per user/portfolio/risk/param under the user's hidden .history
+// directory, each line is a json array [tm, group state key, value]
+func (self *RiskParamDef) historyFile() string {
+	riskDef := self.Parent
+	portfolio := riskDef.Portfolio
+	name := url.PathEscape(portfolio.Name) + "." + url.PathEscape(riskDef.DisplayName) + "." + url.PathEscape(self.Name)
+	return path.Join(GetPath(portfolio.UserId), ".history", name)
+}
+
+// append points by group state key to the history file, false on failure
+func (self *RiskParamDef) writeHistory(points map[string][][2]float64) bool {
+	fn := self.historyFile()
+	if err := os.MkdirAll(path.Dir(fn), 0755); err != nil {
+		log.Println("failed to create history dir:", err)
+		return false
+	}
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("failed to open history file:", err)
+		return false
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for key, tmp := range points {
+		for _, pt := range tmp {
+			line, _ := json.Marshal([]interface{}{pt[0], key, pt[1]})
+			w.Write(append(line, '\n'))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Println("failed to write history file:", err)
+		return false
+	}
+	return true
+}
+
+func (self *RiskParamDef) loadHistory() {
+	fn := self.historyFile()
+	f, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	since := float64(time.Now().Unix()) - self.HistoryRetention
+	var kept [][3]interface{}
+	expired := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var tmp [3]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &tmp); err != nil {
+			continue
+		}
+		tm, ok1 := tmp[0].(float64)
+		key, ok2 := tmp[1].(string)
+		v, ok3 := tmp[2].(float64)
+		if !ok1 || !ok2 || !ok3 || tm < since {
+			expired = true
+			continue
+		}
+		// written before groups were keyed by group spec
+		if !strings.Contains(key, "|") {
+			key = groupStateKey(0, key)
+			tmp[1] = key
+			expired = true
+		}
+		h := self.History[key]
+		if n := len(h); n > 0 && h[n-1][0] >= tm {
+			expired = true
+			continue
+		}
+		self.History[key] = append(h, [2]float64{tm, v})
+		self.savedHistory[key] = tm
+		kept = append(kept, tmp)
+	}
+	f.Close()
+	if !expired {
+		return
+	}
+	// drop expired lines, otherwise the file is only appended to
+	tmpFn := fn + ".tmp"
+	out, err := os.Create(tmpFn)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(out)
+	for _, tmp := range kept {
+		line, _ := json.Marshal(tmp)
+		w.Write(append(line, '\n'))
+	}
+	w.Flush()
+	out.Close()
+	os.Rename(tmpFn, fn)
+}
+
+// persist the points not written yet, except the last of every group which
+// is still being updated in memory unless all, i.e. on reparse and on exit.
+// The file is written without holding self.mutex.
+func (self *RiskParamDef) flushHistory(all bool) {
+	if self.Parent.Portfolio == nil || self.Parent.Portfolio.UserId <= 0 {
+		return
+	}
+	points := make(map[string][][2]float64)
+	self.mutex.Lock()
+	for key, h := range self.History {
+		n := len(h)
+		if !all {
+			n -= 1
+		}
+		last, ok := self.savedHistory[key]
+		for i := 0; i < n; i++ {
+			if !ok || h[i][0] > last {
+				points[key] = append(points[key], h[i])
+			}
+		}
+	}
+	self.mutex.Unlock()
+	if len(points) == 0 || !self.writeHistory(points) {
+		return
+	}
+	self.mutex.Lock()
+	for key, tmp := range points {
+		self.savedHistory[key] = tmp[len(tmp)-1][0]
+	}
+	self.mutex.Unlock()
+}
+
+func (p *Portfolio) loadHistory() {
+	for _, riskDef := range p.RiskDefs {
+		for _, rp := range riskDef.Params {
+			if rp.Graph {
+				rp.loadHistory()
+			}
+		}
+	}
+}
+
+func (p *Portfolio) flushHistory(all bool) {
+	for _, riskDef := range p.RiskDefs {
+		for _, rp := range riskDef.Params {
+			if rp.Graph {
+				rp.flushHistory(all)
+			}
+		}
+	}
+}
+
+func FlushHistory(all bool) {
+	for _, portfolios := range UserPortfolios {
+		for _, p := range portfolios {
+			p.flushHistory(all)
+		}
+	}
+}
+
+// copy of the points within [from, to]
+func (self *RiskParamDef) GetHistory(from float64, to float64) map[string][][2]float64 {
+	out := make(map[string][][2]float64)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for gname, h := range self.History {
+		for _, pt := range h {
+			if pt[0] >= from && pt[0] <= to {
+				out[gname] = append(out[gname], pt)
+			}
+		}
+	}
+	return out
+}
+
+// OHLC of the points within [from, to] per bucket seconds, each item is [tm, open, high, low, close]
+func (self *RiskParamDef) DownsampleHistory(from float64, to float64, bucket float64) map[string][][5]float64 {
+	out := make(map[string][][5]float64)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for gname, h := range self.History {
+		var res [][5]float64
+		for _, pt := range h {
+			if pt[0] < from || pt[0] > to {
+				continue
+			}
+			tm := math.Floor(pt[0]/bucket) * bucket
+			n := len(res)
+			if n == 0 || res[n-1][0] != tm {
+				res = append(res, [5]float64{tm, pt[1], pt[1], pt[1], pt[1]})
+				continue
+			}
+			last := &res[n-1]
+			last[2] = math.Max(last[2], pt[1])
+			last[3] = math.Min(last[3], pt[1])
+			last[4] = pt[1]
+		}
+		if len(res) > 0 {
+			out[gname] = res
+		}
+	}
+	return out
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closed points are written once, the last one still being updated only on exit
+func TestFlushHistory(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	cfg, err := ParseIni("[gross]\nformula=sum(Pos*Close)\ngraph=Y\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio, err := ParsePortfolio(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio.Name = "test"
+	portfolio.UserId = 3
+	rp := portfolio.RiskDefs[0].Params[0]
+	key := groupStateKey(0, "")
+	now := float64(time.Now().Unix())
+	rp.History[key] = [][2]float64{{now, 1}, {now + 10, 2}}
+	lines := func() int {
+		b, _ := ioutil.ReadFile(rp.historyFile())
+		return strings.Count(string(b), "\n")
+	}
+	rp.flushHistory(false)
+	rp.flushHistory(false)
+	if n := lines(); n != 1 {
+		t.Fatalf("%d lines, want 1", n)
+	}
+	// the last point moved and another one followed
+	rp.History[key] = [][2]float64{{now, 1}, {now + 15, 3}, {now + 30, 4}}
+	rp.flushHistory(false)
+	rp.flushHistory(true)
+	rp.flushHistory(true)
+	if n := lines(); n != 3 {
+		t.Fatalf("%d lines, want 3", n)
+	}
+	want := rp.History[key]
+	rp.History = make(map[string][][2]float64)
+	rp.savedHistory = make(map[string]float64)
+	rp.loadHistory()
+	if !reflect.DeepEqual(rp.History[key], want) {
+		t.Errorf("loaded %v, want %v", rp.History[key], want)
+	}
+}
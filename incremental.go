@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+)
+
+var incrementalAggregates = []string{"sum", "len", "mean", "std"}
+
+// recompute totals from contributions every so many runs against float drift
+const aggregateRebuildRuns = 1000
+
+type posKey struct {
+	Acc        int
+	SecurityId int64
+}
+
+type contribution struct {
+	Value float64
+	Run   int
+}
+
+// per group contribution of each position and running totals, NaN contributions are
+// counted separately since they make the whole aggregate NaN
+type Aggregate struct {
+	values map[posKey]*contribution
+	run    int
+	seq    int64 // of the State last run on, see copyState
+	sum    float64
+	mean   float64
+	m2     float64 // sum of squared deviations from mean, see add
+	n      int
+	nan    int
+}
+
+// Welford's update for adding (sign 1) or removing (sign -1) v, so that std
+// does not suffer from cancellation with large values of small spread
+func (self *Aggregate) add(v float64, sign int) {
+	if math.IsNaN(v) {
+		self.nan += sign
+		return
+	}
+	self.sum += float64(sign) * v
+	if sign > 0 {
+		self.n++
+		d := v - self.mean
+		self.mean += d / float64(self.n)
+		self.m2 += d * (v - self.mean)
+		return
+	}
+	self.n--
+	if self.n <= 0 {
+		self.n, self.sum, self.mean, self.m2 = 0, 0, 0, 0
+		return
+	}
+	mean := self.mean - (v-self.mean)/float64(self.n)
+	self.m2 -= (v - mean) * (v - self.mean)
+	self.mean = mean
+}
+
+// exact totals from the contributions, two-pass for std, against drift
+func (self *Aggregate) rebuild() {
+	self.sum, self.mean, self.m2, self.n, self.nan = 0, 0, 0, 0, 0
+	for _, c := range self.values {
+		if math.IsNaN(c.Value) {
+			self.nan++
+			continue
+		}
+		self.sum += c.Value
+		self.n++
+	}
+	if self.n == 0 {
+		return
+	}
+	self.mean = self.sum / float64(self.n)
+	for _, c := range self.values {
+		if !math.IsNaN(c.Value) {
+			self.m2 += (c.Value - self.mean) * (c.Value - self.mean)
+		}
+	}
+}
+
+func (self *Aggregate) value(a string) float64 {
+	if a == "len" {
+		return float64(self.n + self.nan)
+	}
+	if self.nan > 0 {
+		return math.NaN()
+	}
+	switch a {
+	case "sum":
+		return self.sum
+	case "mean":
+		if self.n == 0 {
+			return math.NaN()
+		}
+		return self.mean
+	case "std":
+		if self.n == 0 {
+			return math.NaN()
+		}
+		return math.Sqrt(math.Max(self.m2/float64(self.n), 0))
+	}
+	return math.NaN()
+}
+
+// same as value() but only evaluates the formula for positions changed since last run,
+// must be called with self.mutex held. Inputs other than positions and prices
+// mark positions changed as well: reference data reloads, python restarts and
+// risk_refresh (time dependent values, e.g. Theta) mark everything dirty, fx
+// changes mark the positions of portfolios depending on fx, see getPositions.
+func (self *RiskParamDef) incrementalValue(key string, positions []*Position) interface{} {
+	agg := self.Aggregates[key]
+	if agg == nil {
+		agg = &Aggregate{values: make(map[posKey]*contribution)}
+		self.Aggregates[key] = agg
+	}
+	agg.run++
+	// positions changed since the State last run on, which may be several
+	// copies back if the portfolio was clean or not subscribed meanwhile
+	since := agg.seq
+	if len(positions) > 0 {
+		agg.seq = positions[0].seq
+	}
+	var params map[string]interface{}
+	if len(self.Variables) > 0 {
+		params = make(map[string]interface{}, 60)
+	}
+	for _, p := range positions {
+		pk := posKey{p.Acc, p.Security.Id}
+		c := agg.values[pk]
+		if c != nil && p.changedSeq <= since {
+			c.Run = agg.run
+			continue
+		}
+		v := self.evaluatePos(self.Formula, p, params, true)
+		if c == nil {
+			c = &contribution{}
+			agg.values[pk] = c
+		} else {
+			agg.add(c.Value, -1)
+		}
+		agg.add(v, 1)
+		c.Value = v
+		c.Run = agg.run
+	}
+	for pk, c := range agg.values {
+		if c.Run != agg.run {
+			agg.add(c.Value, -1)
+			delete(agg.values, pk)
+		}
+	}
+	if agg.run%aggregateRebuildRuns == 0 {
+		agg.rebuild()
+	}
+	value := agg.value(self.Formula.A)
+	if math.IsNaN(value) {
+		// json Marshal failed to work with NaN, so change to string
+		return "NaN"
+	}
+	return value
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestIncrementalValue(t *testing.T) {
+	aggs := []string{"sum", "len", "mean", "std"}
+	var ini []string
+	for _, a := range aggs {
+		ini = append(ini, "["+a+"]", "formula="+a+"(Pos*Close)", "incremental=Y")
+	}
+	cfg, err := ParseIni(strings.Join(ini, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio, err := ParsePortfolio(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := func(acc int, id int64, qty float64, close float64) *Position {
+		s := &Security{Id: id, Multiplier: 1, Rate: 1}
+		s.Close = close
+		p := &Position{Acc: acc, Security: s}
+		p.Qty = qty
+		return p
+	}
+	p1 := pos(1, 1, 100, 10)
+	p2 := pos(1, 2, -50, 20)
+	p3 := pos(2, 1, 30, 5)
+	// each step is evaluated on a State copy of seq with the positions changed
+	// since marked changed, as copyState does
+	tests := []struct {
+		seq        int64
+		changedSeq int64 // of the changed positions
+		change     func()
+		changed    []*Position
+		positions  []*Position
+		want       []float64 // sum, len, mean, std
+	}{
+		{1, 1, func() {}, []*Position{p1, p2, p3}, []*Position{p1, p2, p3},
+			[]float64{150, 3, 50, math.Sqrt(2022500./3 - 2500)}},
+		{2, 2, func() { p1.Qty = 200 }, []*Position{p1}, []*Position{p1, p2, p3},
+			[]float64{1150, 3, 1150. / 3, math.Sqrt(5022500./3 - 1150.*1150/9)}},
+		// closed position dropped
+		{3, 3, func() {}, nil, []*Position{p1, p3},
+			[]float64{2150, 2, 1075, 925}},
+		{4, 4, func() { p3.Security.Close = math.NaN() }, []*Position{p3}, []*Position{p1, p3},
+			[]float64{math.NaN(), 2, math.NaN(), math.NaN()}},
+		// changed in copy 5 which this portfolio did not run on
+		{6, 5, func() { p3.Security.Close = 5 }, []*Position{p3}, []*Position{p1, p3},
+			[]float64{2150, 2, 1075, 925}},
+	}
+	for _, tt := range tests {
+		tt.change()
+		for _, p := range tt.positions {
+			p.seq = tt.seq
+		}
+		for _, p := range tt.changed {
+			p.changedSeq = tt.changedSeq
+		}
+		for i, a := range aggs {
+			rp := portfolio.RiskDefs[i].Params[0]
+			rp.mutex.Lock()
+			got := rp.incrementalValue("", tt.positions)
+			rp.mutex.Unlock()
+			v, ok := got.(float64)
+			if !ok {
+				v = math.NaN()
+			}
+			if !floatEqual(v, tt.want[i]) {
+				t.Errorf("seq %d: %s = %v, want %v", tt.seq, a, got, tt.want[i])
+			}
+			if full, _ := rp.value(tt.positions).(float64); !math.IsNaN(v) && !floatEqual(v, full) {
+				t.Errorf("seq %d: %s = %v, full evaluation %v", tt.seq, a, v, full)
+			}
+		}
+	}
+}
+
+func TestAggregateValue(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   []float64 // sum, len, mean, std
+	}{
+		{nil, []float64{0, 0, math.NaN(), math.NaN()}},
+		{[]float64{2, 4, 4, 4, 5, 5, 7, 9}, []float64{40, 8, 5, 2}},
+		{[]float64{1, math.NaN()}, []float64{math.NaN(), 2, math.NaN(), math.NaN()}},
+		// large exposures of small spread
+		{[]float64{1e8 + 2, 1e8 + 4, 1e8 + 4, 1e8 + 4, 1e8 + 5, 1e8 + 5, 1e8 + 7, 1e8 + 9}, []float64{8e8 + 40, 8, 1e8 + 5, 2}},
+		{[]float64{-3e7 + 0.5, -3e7 - 0.5}, []float64{-6e7, 2, -3e7, 0.5}},
+	}
+	names := []string{"sum", "len", "mean", "std"}
+	for _, tt := range tests {
+		agg := &Aggregate{values: make(map[posKey]*contribution)}
+		for i, v := range tt.values {
+			agg.values[posKey{SecurityId: int64(i)}] = &contribution{Value: v}
+		}
+		agg.rebuild()
+		// running totals with other values added and removed in between
+		running := &Aggregate{}
+		for i, v := range tt.values {
+			running.add(v, 1)
+			running.add(v+float64(i), 1)
+		}
+		for i := range tt.values {
+			running.add(tt.values[i]+float64(i), -1)
+		}
+		for i, a := range names {
+			if got := agg.value(a); !floatEqual(got, tt.want[i]) {
+				t.Errorf("%s of %v = %v, want %v", a, tt.values, got, tt.want[i])
+			}
+			if got := running.value(a); math.Abs(got-tt.want[i]) > 1e-6 && !floatEqual(got, tt.want[i]) {
+				t.Errorf("running %s of %v = %v, want %v", a, tt.values, got, tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/thoas/go-funk"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+var lotMethodFlag = flag.String("lot_method", "average", "position accounting method, fifo, lifo or average, or comma separated acc_pattern:method list, e.g. PB*:lifo,*:fifo, the first match wins")
+
+var lotMethodNames = []string{"fifo", "lifo", "average"}
+
+// [acc pattern, method]
+var lotMethods [][2]string
+
+func ParseLotMethods(str string) error {
+	lotMethods = nil
+	for _, tmp := range split(str, ",") {
+		pattern := "*"
+		method := tmp
+		if i := strings.LastIndex(tmp, ":"); i >= 0 {
+			pattern = strings.TrimSpace(tmp[:i])
+			method = strings.TrimSpace(tmp[i+1:])
+		}
+		method = strings.ToLower(method)
+		if !funk.ContainsString(lotMethodNames, method) {
+			return fmt.Errorf("invalid lot method: " + method + ": must be one of " + strings.Join(lotMethodNames, ", "))
+		}
+		lotMethods = append(lotMethods, [2]string{pattern, method})
+	}
+	return nil
+}
+
+func lotMethod(accName string) string {
+	for _, tmp := range lotMethods {
+		if matched, _ := filepath.Match(tmp[0], accName); matched {
+			return tmp[1]
+		}
+	}
+	return "average"
+}
+
+// open lot, Qty is negative for short
+type Lot struct {
+	Tm  int64 // time of the trade as sent by trade server, 0 for bod
+	Qty float64
+	Px  float64
+}
+
+// trade of signed qty at px closes lots of the opposite side, the oldest first
+// unless lifo, and opens a new lot with the rest. Lots are never modified in
+// place, so that copies of positions can share them. Returns realized pnl
+// before multiplier.
+func tradeLots(lots []Lot, qty float64, px float64, tm int64, lifo bool) ([]Lot, float64) {
+	out := append(make([]Lot, 0, len(lots)+1), lots...)
+	realized := 0.
+	for qty != 0 && len(out) > 0 {
+		i := 0
+		if lifo {
+			i = len(out) - 1
+		}
+		lot := &out[i]
+		if (lot.Qty > 0) == (qty > 0) {
+			break
+		}
+		closed := math.Min(math.Abs(qty), math.Abs(lot.Qty))
+		if lot.Qty < 0 {
+			closed = -closed
+		}
+		realized += (px - lot.Px) * closed
+		lot.Qty -= closed
+		qty += closed
+		if lot.Qty == 0 {
+			out = append(out[:i], out[i+1:]...)
+		}
+	}
+	if qty != 0 {
+		out = append(out, Lot{Tm: tm, Qty: qty, Px: px})
+	}
+	return out, realized
+}
+
+// average price of open lots, px if none
+func lotsAvgPx(lots []Lot, px float64) float64 {
+	qty := 0.
+	value := 0.
+	for _, lot := range lots {
+		qty += lot.Qty
+		value += lot.Qty * lot.Px
+	}
+	if qty == 0 {
+		return px
+	}
+	return value / qty
+}
+
+// fill applied to a position since bod, kept so that the position can be
+// rebuilt when a trade is busted or the lot method of its account changes
+type Fill struct {
+	OrderId    int64
+	TradeId    string
+	Tm         int64
+	Qty        float64 // negative for sell
+	Px         float64
+	Multiplier float64 // rate times multiplier of the security at the time of the trade
+}
+
+// whether the bust b reverses f, by trade id if both have one, otherwise by
+// order, qty and px
+func (f *Fill) bustedBy(b Fill) bool {
+	if f.TradeId != "" && b.TradeId != "" {
+		return f.TradeId == b.TradeId
+	}
+	return f.OrderId == b.OrderId && f.Qty == -b.Qty && f.Px == b.Px
+}
+
+// apply fill f to qty, avg px, realized pnl and lots of the position
+func (p *Position) fill(f Fill, method string) {
+	qty0 := p.Qty
+	qty := f.Qty
+	px := f.Px
+	multiplier := f.Multiplier
+	lots, realized := tradeLots(p.Lots, qty, px, f.Tm, method == "lifo")
+	p.Lots = lots
+	if method != "average" {
+		p.RealizedPnl += realized * multiplier
+		p.AvgPx = lotsAvgPx(lots, px)
+	} else if (qty0 > 0) && (qty < 0) { // sell trade to cover position
+		if qty0 > -qty {
+			p.RealizedPnl += (px - p.AvgPx) * -qty * multiplier
+		} else {
+			p.RealizedPnl += (px - p.AvgPx) * qty0 * multiplier
+			p.AvgPx = px
+		}
+	} else if (qty0 < 0) && (qty > 0) { // buy trade to cover position
+		if -qty0 > qty {
+			p.RealizedPnl += (p.AvgPx - px) * qty * multiplier
+		} else {
+			p.RealizedPnl += (p.AvgPx - px) * -qty0 * multiplier
+			p.AvgPx = px
+		}
+	} else { // open position
+		p.AvgPx = (qty0*p.AvgPx + qty*px) / (qty0 + qty)
+	}
+	p.Qty += qty
+	p.LotMethod = method
+}
+
+// removes the fill busted by b, the latest match, and rebuilds the position
+// without it. Returns false if no fill matches.
+func (p *Position) bust(b Fill) bool {
+	for i := len(p.Fills) - 1; i >= 0; i-- {
+		if p.Fills[i].bustedBy(b) {
+			fills := make([]Fill, 0, len(p.Fills)-1)
+			fills = append(fills, p.Fills[:i]...)
+			p.Fills = append(fills, p.Fills[i+1:]...)
+			p.rebuild()
+			return true
+		}
+	}
+	return false
+}
+
+// qty, avg px, realized pnl and lots from bod and the fills since, with the
+// lot method of the account name the position currently has
+func (p *Position) rebuild() {
+	p.PositionBase = p.Bod
+	p.Lots = nil
+	if p.Qty != 0 {
+		p.Lots = []Lot{{Qty: p.Qty, Px: p.AvgPx}}
+	}
+	method := lotMethod(p.AccName)
+	p.LotMethod = method
+	for _, f := range p.Fills {
+		p.fill(f, method)
+	}
+}
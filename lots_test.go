@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLotMethod(t *testing.T) {
+	if err := ParseLotMethods("PB*:lifo, F?:fifo"); err != nil {
+		t.Fatal(err)
+	}
+	defer ParseLotMethods(*lotMethodFlag)
+	tests := []struct {
+		accName string
+		want    string
+	}{
+		{"PB1", "lifo"},
+		{"F1", "fifo"},
+		{"F12", "average"},
+		{"", "average"},
+	}
+	for _, tt := range tests {
+		if got := lotMethod(tt.accName); got != tt.want {
+			t.Errorf("lotMethod(%q) = %s, want %s", tt.accName, got, tt.want)
+		}
+	}
+	if err := ParseLotMethods("*:hifo"); err == nil {
+		t.Error("invalid lot method accepted")
+	}
+}
+
+func TestTradeLots(t *testing.T) {
+	lots := []Lot{{1, 100, 10}, {2, 100, 12}}
+	tests := []struct {
+		name     string
+		qty, px  float64
+		lifo     bool
+		want     []Lot
+		realized float64
+	}{
+		{"fifo partial close", -150, 15, false, []Lot{{2, 50, 12}}, 650},
+		{"lifo partial close", -150, 15, true, []Lot{{1, 50, 10}}, 550},
+		{"fifo reverse", -250, 15, false, []Lot{{3, -50, 15}}, 800},
+		{"add", 50, 11, false, []Lot{{1, 100, 10}, {2, 100, 12}, {3, 50, 11}}, 0},
+	}
+	for _, tt := range tests {
+		got, realized := tradeLots(lots, tt.qty, tt.px, 3, tt.lifo)
+		if !reflect.DeepEqual(got, tt.want) || realized != tt.realized {
+			t.Errorf("%s: %v, %v, want %v, %v", tt.name, got, realized, tt.want, tt.realized)
+		}
+	}
+	// shared with copies, so never modified in place
+	if !reflect.DeepEqual(lots, []Lot{{1, 100, 10}, {2, 100, 12}}) {
+		t.Errorf("lots modified in place: %v", lots)
+	}
+}
+
+// buy 100@10, buy 100@12, sell 150@15
+func TestPositionLots(t *testing.T) {
+	if err := ParseLotMethods("F*:fifo,L*:lifo,*:average"); err != nil {
+		t.Fatal(err)
+	}
+	defer ParseLotMethods(*lotMethodFlag)
+	fills := []struct {
+		tradeId string
+		side    string
+		qty, px float64
+	}{
+		{"t1", "buy", 100, 10},
+		{"t2", "buy", 100, 12},
+		{"t3", "sell", 150, 15},
+	}
+	tests := []struct {
+		accName  string
+		avgPx    float64
+		realized float64
+	}{
+		{"F1", 12, 650},
+		{"L1", 10, 550},
+		{"A1", 11, 600},
+	}
+	for _, tt := range tests {
+		s := &Security{Id: 1, Multiplier: 1, Rate: 1}
+		p := &Position{AccName: tt.accName, Security: s}
+		for i, f := range fills {
+			p.update(&Order{Id: int64(i + 1), St: "filled", Type: "otc", Security: s, Side: f.side, LastQty: f.qty, LastPx: f.px, LastTradeId: f.tradeId})
+		}
+		if p.Qty != 50 || p.AvgPx != tt.avgPx || p.RealizedPnl != tt.realized {
+			t.Errorf("%s: qty %v avg px %v realized %v, want 50, %v, %v", tt.accName, p.Qty, p.AvgPx, p.RealizedPnl, tt.avgPx, tt.realized)
+		}
+	}
+}
+
+func TestPositionRebuild(t *testing.T) {
+	if err := ParseLotMethods("F*:fifo,*:average"); err != nil {
+		t.Fatal(err)
+	}
+	defer ParseLotMethods(*lotMethodFlag)
+	s := &Security{Id: 1, Multiplier: 1, Rate: 1}
+	p := &Position{Security: s}
+	p.Bod = PositionBase{Qty: 100, AvgPx: 10}
+	p.PositionBase = p.Bod
+	p.Lots = []Lot{{Qty: 100, Px: 10}}
+	trade := func(id int64, tradeId string, side string, qty float64, px float64) {
+		p.update(&Order{Id: id, St: "filled", Type: "otc", Security: s, Side: side, LastQty: qty, LastPx: px, LastTradeId: tradeId})
+	}
+	trade(1, "t1", "buy", 100, 12)
+	trade(2, "t2", "sell", 150, 15)
+	// average until the account name arrives
+	if p.AvgPx != 11 || p.RealizedPnl != 600 {
+		t.Fatalf("average: avg px %v realized %v, want 11, 600", p.AvgPx, p.RealizedPnl)
+	}
+	p.AccName = "F1"
+	p.rebuild()
+	if p.Qty != 50 || p.AvgPx != 12 || p.RealizedPnl != 650 || !reflect.DeepEqual(p.Lots, []Lot{{0, 50, 12}}) {
+		t.Fatalf("fifo: qty %v avg px %v realized %v lots %v, want 50, 12, 650, [{0 50 12}]", p.Qty, p.AvgPx, p.RealizedPnl, p.Lots)
+	}
+	// bust of the buy by trade id, the sell then closes the bod lot and opens a short
+	trade(1, "t1", "buy", -100, 12)
+	if p.Qty != -50 || p.AvgPx != 15 || p.RealizedPnl != 500 || len(p.Fills) != 1 {
+		t.Fatalf("bust: qty %v avg px %v realized %v fills %v, want -50, 15, 500, 1", p.Qty, p.AvgPx, p.RealizedPnl, len(p.Fills))
+	}
+	// bust without trade id matched by order, qty and px
+	trade(2, "", "sell", -150, 15)
+	if p.Qty != 100 || p.AvgPx != 10 || p.RealizedPnl != 0 || len(p.Fills) != 0 {
+		t.Fatalf("bust: qty %v avg px %v realized %v fills %v, want 100, 10, 0, 0", p.Qty, p.AvgPx, p.RealizedPnl, len(p.Fills))
+	}
+	if p.BuyQty != 0 || p.SellQty != 0 {
+		t.Fatalf("bust: buy qty %v sell qty %v, want 0, 0", p.BuyQty, p.SellQty)
+	}
+}
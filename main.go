@@ -2,19 +2,22 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
 	"github.com/unrolled/render"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -30,14 +33,23 @@ const (
 
 	// Maximum msg size allowed from peer.
 	// maxMessageSize = 512
+
+	// Wait before redialing trade server, doubled on every failure up to maxReconnectWait.
+	minReconnectWait = time.Second
+	maxReconnectWait = 30 * time.Second
 )
 
 var addr = flag.String("addr", "0.0.0.0:9113", "http service address")
 var server = flag.String("server", "ws://localhost:9111/ot/", "trade server address")
 var username = flag.String("username", "admin", "username to login to trade server")
 var passwd = flag.String("passwd", "test", "passwd to login to trade server")
+var riskDelay = flag.Duration("risk_delay", 10*time.Millisecond, "delay of risk evaluation after a change, to batch changes together")
+var riskInterval = flag.Duration("risk_interval", 100*time.Millisecond, "minimum interval between risk evaluations")
+var riskSnapshotInterval = flag.Duration("risk_snapshot_interval", time.Second, "minimum interval between full risk reports to clients not in delta mode")
+var riskRefresh = flag.Duration("risk_refresh", time.Minute, "interval of re-evaluating all portfolios even if nothing changed, for time dependent values, e.g. Theta, and python results, 0 to disable")
 var rd = render.New()
 var chWriteTradeServer = make(chan []interface{})
+var jobDone atomic.Value // chan bool of the current tradeServerJob, closed when it ends
 var clients = sync.Map{}
 var clientCounter int64 = 0
 
@@ -49,11 +61,8 @@ func index(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	rd.JSON(w, http.StatusOK, map[string]interface{}{"hello": "index page"})
 }
 
-func api(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	fmt.Fprintf(w, "api: %s\n", p.ByName("name"))
-}
-
-func publish2Client(ch chan []byte, c *websocket.Conn) {
+func publish2Client(client *Client) {
+	c := client.Conn
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		log.Println("publish2Client ended")
@@ -62,7 +71,7 @@ func publish2Client(ch chan []byte, c *websocket.Conn) {
 	}()
 	for {
 		select {
-		case msg := <-ch:
+		case msg := <-client.Ch:
 			c.SetWriteDeadline(time.Now().Add(writeWait))
 			err := c.WriteMessage(websocket.TextMessage, msg)
 			if err != nil {
@@ -75,40 +84,72 @@ func publish2Client(ch chan []byte, c *websocket.Conn) {
 				log.Print(err)
 				return
 			}
+		case <-client.done:
+			return
 		}
 	}
 }
 
 type Client struct {
 	Ch     chan []byte
-	UserId int
 	Conn   *websocket.Conn
+	userId int64
+	done   chan bool
+	// only touched by tradeServerJob: delta mode sends riskDelta against lastRisk,
+	// others get full reports at most every riskSnapshotInterval
+	Delta       bool
+	lastRisk    map[string]*RiskCell
+	lastFull    time.Time
+	riskPending bool          // full report skipped within riskSnapshotInterval
+	Subs        Subscriptions // nil for all portfolios
 }
 
-func serveClient(w http.ResponseWriter, r *http.Request) {
-	n := atomic.AddInt64(&clientCounter, 1)
-	self := &Client{}
-	clients.Store(n, self)
+// next report is sent in full right away
+func (self *Client) resetRisk() {
+	self.lastRisk = nil
+	self.lastFull = time.Time{}
+}
+
+func (self *Client) UserId() int {
+	return int(atomic.LoadInt64(&self.userId))
+}
 
+func (self *Client) SetUserId(userId int) {
+	atomic.StoreInt64(&self.userId, int64(userId))
+}
+
+// never blocks on a closed connection
+func (self *Client) Send(msg []byte) {
+	select {
+	case self.Ch <- msg:
+	case <-self.done:
+	}
+}
+
+func serveClient(w http.ResponseWriter, r *http.Request) {
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
 	}
+	n := atomic.AddInt64(&clientCounter, 1)
 	log.Println("received client connection", n)
-	ch := make(chan []byte)
-	self.Ch = ch
-	self.Conn = c
+	self := &Client{
+		Ch:   make(chan []byte),
+		Conn: c,
+		done: make(chan bool),
+	}
+	clients.Store(n, self)
 	defer func() {
 		log.Println("client connection", n, "closed")
 		clients.Delete(n)
-		close(ch)
+		close(self.done)
 		c.Close()
 	}()
 	// c.SetReadLimit(maxMessageSize)
 	c.SetReadDeadline(time.Now().Add(pongWait))
 	c.SetPongHandler(func(string) error { c.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	go publish2Client(ch, c)
+	go publish2Client(self)
 	for {
 		// mt is an int with value
 		// websocket.BinaryMessage or websocket.TextMessage
@@ -134,27 +175,27 @@ func serveClient(w http.ResponseWriter, r *http.Request) {
 				err = ioutil.WriteFile(tmp, []byte(content), 0755)
 				if err != nil {
 					str, _ := json.Marshal([]interface{}{"saveRiskFile", fn, err.Error()})
-					ch <- str
+					self.Send(str)
 					continue
 				}
 				err = CheckPy(tmp)
 				os.Remove(tmp)
 				if err != nil {
 					str, _ := json.Marshal([]interface{}{"saveRiskFile", fn, err.Error()})
-					ch <- str
+					self.Send(str)
 					continue
 				}
 			} else if path.Ext(fn) == ".ini" {
 				cfg, err := ParseIni(content)
 				if err != nil {
 					str, _ := json.Marshal([]interface{}{"saveRiskFile", fn, err.Error()})
-					ch <- str
+					self.Send(str)
 					continue
 				}
-				_, err = ParsePortfolio(cfg, GetPath(self.UserId))
+				_, err = ParsePortfolio(cfg, GetPath(self.UserId()))
 				if err != nil {
 					str, _ := json.Marshal([]interface{}{"saveRiskFile", fn, err.Error()})
-					ch <- str
+					self.Send(str)
 					continue
 				}
 			}
@@ -166,35 +207,109 @@ func serveClient(w http.ResponseWriter, r *http.Request) {
 
 type Array []interface{}
 
+// dropped if the trade server is not connected, the subscriptions are
+// requested again by Resubscribe on the next login
 func Request(msg Array) {
+	done, _ := jobDone.Load().(chan bool)
+	if done == nil {
+		return
+	}
+	select {
+	case <-done:
+		return
+	default:
+	}
 	// deadlock in ch if read/write on the same goroutine, so spawn a new goroutine here
 	go func() {
-		chWriteTradeServer <- msg
+		select {
+		case chWriteTradeServer <- msg:
+		case <-done:
+		}
 	}()
 }
 
+// ticks every d, never if d is not positive, stop must be called when done
+func newTicker(d time.Duration) (<-chan time.Time, func()) {
+	if d <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
 func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 	c.SetReadDeadline(time.Now().Add(pongWait))
 	c.SetPongHandler(func(string) error { c.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	riskTicker := time.NewTicker(time.Second)
 	pingTicker := time.NewTicker(pingPeriod)
+	snapshotC, stopSnapshot := newTicker(*snapshotInterval)
+	historyC, stopHistory := newTicker(*historyFlushInterval)
+	// risk is evaluated on its own goroutine on a copy of the state, one run at a time,
+	// scheduled riskDelay after something changes but not within riskInterval of the last run
+	chRisk := make(chan map[int]map[string]interface{}, 1)
+	evaluating := false
+	scheduled := false
+	var lastEval time.Time
+	lastRefresh := time.Now()
+	riskTimer := time.NewTimer(time.Hour)
+	riskTimer.Stop()
 	defer func() {
 		log.Println("tradeServerJob ended")
+		riskTimer.Stop()
 		riskTicker.Stop()
 		pingTicker.Stop()
+		stopSnapshot()
+		stopHistory()
 	}()
 	for {
+		if !evaluating && !scheduled && IsDirty() {
+			wait := *riskDelay
+			if tmp := *riskInterval - time.Since(lastEval); tmp > wait {
+				wait = tmp
+			}
+			riskTimer.Reset(wait)
+			scheduled = true
+		}
 		select {
 		case msg, _ := <-chWriteTradeServer:
 			action, _ := msg[0].(string)
-			if action == "riskFile" || action == "saveRiskFile" || action == "deleteRiskFile" || action == "historicalRisk" {
+			if action == "subscribe" || action == "unsubscribe" {
+				n, _ := msg[len(msg)-1].(int64)
+				tmp, _ := clients.Load(n)
+				if tmp != nil {
+					tmp.(*Client).Subscribe(msg[:len(msg)-1])
+				}
+			} else if action == "riskDelta" || action == "riskSnapshot" {
+				// ["riskDelta", true|false] switches delta mode, ["riskSnapshot"] asks for a full report,
+				// both answered with a full risk report on next tick
+				n, _ := msg[len(msg)-1].(int64)
+				tmp, _ := clients.Load(n)
+				if tmp != nil {
+					client := tmp.(*Client)
+					if action == "riskDelta" {
+						client.Delta, _ = msg[1].(bool)
+					}
+					client.resetRisk()
+				}
+			} else if action == "preTrade" {
+				n, _ := msg[len(msg)-1].(int64)
+				tmp, _ := clients.Load(n)
+				if tmp != nil {
+					client := tmp.(*Client)
+					if client.UserId() <= 0 {
+						continue
+					}
+					str, _ := json.Marshal(PreTrade(client.UserId(), msg[:len(msg)-1]))
+					client.Send(str)
+				}
+			} else if action == "riskFile" || action == "saveRiskFile" || action == "deleteRiskFile" || action == "historicalRisk" {
 				n, _ := msg[len(msg)-1].(int64)
 				tmp, _ := clients.Load(n)
 				if tmp != nil {
 					client := tmp.(*Client)
 					out := []interface{}{action}
 					if action == "historicalRisk" {
-						portfolios := UserPortfolios[client.UserId]
+						portfolios := UserPortfolios[client.UserId()]
 						if portfolios == nil {
 							continue
 						}
@@ -208,24 +323,29 @@ func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 						out = append(out, portfolioName)
 						out = append(out, riskName)
 						out = append(out, paramName)
-						for _, r := range portfolio.RiskDefs {
-							if riskName == r.DisplayName {
-								for _, rp := range r.Params {
-									if rp.Name == paramName {
-										if rp.Graph {
-											out = append(out, rp.History)
-										}
-										break
-									}
+						rp := portfolio.FindParam(riskName, paramName)
+						if rp != nil && rp.Graph {
+							// optional: from, to, bucket seconds for OHLC downsampled series
+							if len(msg) > 7 {
+								from, _ := msg[4].(float64)
+								to, _ := msg[5].(float64)
+								bucket, _ := msg[6].(float64)
+								if to <= 0 {
+									to = float64(time.Now().Unix())
 								}
-								break
+								if bucket <= 0 {
+									bucket = rp.HistoryResolution
+								}
+								out = append(out, rp.DownsampleHistory(from, to, bucket), from, to, bucket)
+							} else {
+								out = append(out, rp.GetHistory(0, math.Inf(1)))
 							}
 						}
 					} else {
 						fn, _ := msg[1].(string)
 						out = append(out, fn)
 						if action == "riskFile" {
-							content, err := GetFile(client.UserId, fn)
+							content, err := GetFile(client.UserId(), fn)
 							if err == nil {
 								out = append(out, string(content))
 							} else {
@@ -233,26 +353,28 @@ func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 								out = append(out, err.Error())
 							}
 						} else if action == "deleteRiskFile" {
-							err := DeleteFile(client.UserId, fn)
+							err := DeleteFile(client.UserId(), fn)
 							if err != nil {
 								out = append(out, err.Error)
 							}
 						} else if action == "saveRiskFile" {
-							err := SaveFile(client.UserId, fn, msg[2].(string))
+							err := SaveFile(client.UserId(), fn, msg[2].(string))
 							if err != nil {
 								out = append(out, err.Error)
 							}
 						}
 					}
 					str, _ := json.Marshal(out)
-					client.Ch <- str
+					client.Send(str)
 				}
 			} else {
 				c.SetWriteDeadline(time.Now().Add(writeWait))
 				str, _ := json.Marshal(msg)
 				err := c.WriteMessage(websocket.TextMessage, str)
 				if err != nil {
-					log.Fatal("trade server: ", err)
+					log.Print("trade server write error: ", err)
+					c.Close()
+					return
 				}
 			}
 		case msg, ok := <-ch:
@@ -261,6 +383,8 @@ func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 				return
 			}
 			action := msg[0].(string)
+			metricMessages.Add(1, action)
+			metricLastMessage.Set(float64(time.Now().Unix()))
 			if action == "connection" {
 				status := msg[1].(string)
 				if status != "ok" {
@@ -279,8 +403,12 @@ func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 				ParseSecurity(msg)
 			} else if action == "securities" {
 				log.Printf("%s", msg)
-				Request(Array{"bod"})
-				Request(Array{"offline", 0})
+				InitFxRates()
+				Resubscribe()
+				if !bodDone {
+					Request(Array{"bod"})
+				}
+				Request(Array{"offline", seqNum})
 			} else if action == "bod" {
 				ParseBod(msg)
 			} else if action == "offline" {
@@ -294,17 +422,23 @@ func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 			} else if action == "user_validation" {
 				userId := int(msg[1].(float64))
 				token := int64(msg[2].(float64))
+				if ApiUserValidated(token, userId) {
+					continue
+				}
 				tmp, _ := clients.Load(token)
 				if tmp == nil {
 					continue
 				}
 				client := tmp.(*Client)
 				if userId > 0 {
-					client.UserId = userId
+					client.SetUserId(userId)
+					client.resetRisk()
+					MarkAllDirty()
 					log.Println("client", int(token), ":", userId)
 					if out, err := json.Marshal([]interface{}{"riskFiles", GetFiles(userId)}); err == nil {
-						client.Ch <- out
+						client.Send(out)
 					}
+					PublishActiveAlerts(client)
 				} else {
 					client.Conn.Close()
 				}
@@ -325,37 +459,83 @@ func tradeServerJob(ch chan []interface{}, c *websocket.Conn) {
 			c.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
 				log.Print(err)
+				c.Close()
 				return
 			}
+		case fn := <-chApi:
+			fn()
+		case <-snapshotC:
+			SaveSnapshot()
+		case <-historyC:
+			FlushHistory(false)
 		case <-riskTicker.C:
-			rpts := RunUserPortfolios()
-			clients.Range(func(_, c interface{}) bool {
-				client := c.(*Client)
-				rpt := rpts[client.UserId]
-				out, err := json.Marshal([]interface{}{"risk", rpt})
-				if err != nil {
-					log.Println("failed to Marshal:", rpt)
-					return true
-				}
-				client.Ch <- out
-				return true
-			})
+			metricSeqNum.Set(float64(seqNum))
+			metricOnlineCache.Set(float64(len(onlineCache)))
+			// windows move with time even if nothing else changes
+			dirtyWindows = true
+			if *riskRefresh > 0 && time.Since(lastRefresh) >= *riskRefresh {
+				lastRefresh = time.Now()
+				allDirty = true
+			}
+			PublishPendingRisk(lastReports)
+		case <-riskTimer.C:
+			scheduled = false
+			evaluating = true
+			lastEval = time.Now()
+			state := TakeState()
+			go func() {
+				tm := time.Now()
+				rpts := RunUserPortfolios(state)
+				metricTickSeconds.Since(tm)
+				chRisk <- rpts
+			}()
+		case rpts := <-chRisk:
+			evaluating = false
+			lastReports = rpts
+			PublishRisk(rpts)
+			PublishAlerts()
 		}
 	}
 }
 
 func tradeServer() {
+	wait := minReconnectWait
+	for {
+		tm := time.Now()
+		err := connectTradeServer()
+		log.Print("trade server: ", err)
+		if time.Since(tm) > maxReconnectWait {
+			wait = minReconnectWait
+		}
+		log.Printf("reconnecting to trade server in %s", wait)
+		time.Sleep(wait)
+		wait *= 2
+		if wait > maxReconnectWait {
+			wait = maxReconnectWait
+		}
+	}
+}
+
+func connectTradeServer() error {
 	log.Printf("connecting to trade server: %s", *server)
 	c, _, err := websocket.DefaultDialer.Dial(*server, nil)
 	if err != nil {
-		log.Fatal("dial trade server: ", err)
+		return err
 	}
+	ResetSession()
 	ch := make(chan []interface{})
+	done := make(chan bool)
+	jobDone.Store(done)
 	defer func() {
 		c.Close()
 		close(ch)
+		// make sure the job is gone before the next session touches the order book
+		<-done
+	}()
+	go func() {
+		tradeServerJob(ch, c)
+		close(done)
 	}()
-	go tradeServerJob(ch, c)
 
 	Request(Array{
 		"login",
@@ -367,7 +547,7 @@ func tradeServer() {
 	for {
 		_, raw, err := c.ReadMessage()
 		if err != nil {
-			log.Fatal("trade server: ", err)
+			return err
 		}
 		var msg []interface{}
 		err = json.Unmarshal(raw, &msg)
@@ -375,19 +555,52 @@ func tradeServer() {
 			log.Printf("received non-json msg from trade server: %s", raw)
 			continue
 		}
-		ch <- msg
+		select {
+		case ch <- msg:
+		case <-done:
+			return errors.New("trade server job ended")
+		}
 	}
 }
 
 func main() {
 	flag.Parse()
+	if err := ParseLotMethods(*lotMethodFlag); err != nil {
+		log.Fatal(err)
+	}
+	reloadRefData()
+	reloadScenarios()
+	if pairs, err := LoadFxRates(*fxRatesFile); err != nil {
+		log.Println("failed to load", *fxRatesFile+":", err)
+	} else {
+		fxFilePairs = pairs
+	}
+	go watchFiles(*attributesFile, hotReloadRefData)
+	go watchFiles(*scenariosFile, reloadScenarios)
+	go watchFiles(*fxRatesFile, reloadFxRates)
 	InitPy()
+	RestoreSnapshot()
 	router := httprouter.New()
 	router.GET("/", index)
 	router.GET("/risk/", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		serveClient(w, r)
 	})
-	router.GET("/api/:name", api)
+	router.GET("/metrics", serveMetrics)
+	router.GET("/api/portfolios", apiHandler(apiPortfolios))
+	router.GET("/api/risk/:portfolio", apiHandler(apiRisk))
+	router.GET("/api/risk/:portfolio/:risk/:param/history", apiHandler(apiHistory))
+	router.GET("/api/positions", apiHandler(apiPositions))
+	router.GET("/api/pretrade", apiHandler(apiPreTrade))
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		<-ch
+		// the job goroutine is gone if trade server is disconnected
+		if !onJob(func() { FlushHistory(true) }) {
+			FlushHistory(true)
+		}
+		os.Exit(0)
+	}()
 	log.Print("listening on ", *addr)
 	go tradeServer()
 	log.Fatal(http.ListenAndServe(*addr, router))
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// requests of an ended session do not wait for the next one
+func TestRequestDisconnected(t *testing.T) {
+	saved := jobDone.Load()
+	defer func() {
+		if saved != nil {
+			jobDone.Store(saved)
+		}
+	}()
+	done := make(chan bool)
+	jobDone.Store(done)
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		Request(Array{"sub", int64(i)})
+	}
+	close(done)
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > n {
+		t.Errorf("%d goroutines left blocked", runtime.NumGoroutine()-n)
+	}
+	Request(Array{"sub", int64(1)})
+	select {
+	case msg := <-chWriteTradeServer:
+		t.Errorf("%v sent after the session ended", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minimal prometheus text exposition, see https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var defaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricValue struct {
+	Value  float64
+	Counts []uint64 // histogram only, cumulative per bucket
+	Sum    float64
+	Count  uint64
+}
+
+type Metric struct {
+	Name       string
+	Help       string
+	Type       string // counter, gauge or histogram
+	LabelNames []string
+	Buckets    []float64
+	mutex      sync.Mutex
+	values     map[string]*metricValue
+}
+
+var metrics []*Metric
+
+func newMetric(typ string, name string, help string, labelNames ...string) *Metric {
+	m := &Metric{
+		Name:       name,
+		Help:       help,
+		Type:       typ,
+		LabelNames: labelNames,
+		values:     make(map[string]*metricValue),
+	}
+	if typ == "histogram" {
+		m.Buckets = defaultBuckets
+	}
+	metrics = append(metrics, m)
+	return m
+}
+
+var (
+	metricEvalSeconds   = newMetric("histogram", "openrisk_portfolio_eval_seconds", "Time to evaluate a portfolio.", "user", "portfolio")
+	metricTickSeconds   = newMetric("histogram", "openrisk_tick_eval_seconds", "Time to evaluate all portfolios of all users in one tick.")
+	metricPositions     = newMetric("gauge", "openrisk_portfolio_positions", "Number of positions covered by a portfolio.", "user", "portfolio")
+	metricClients       = newMetric("gauge", "openrisk_clients", "Number of connected websocket clients.", "logged_in")
+	metricMessages      = newMetric("counter", "openrisk_trade_server_messages_total", "Messages received from trade server by action.", "action")
+	metricSeqNum        = newMetric("gauge", "openrisk_trade_server_seq_num", "Sequence number of the last order message applied.")
+	metricOnlineCache   = newMetric("gauge", "openrisk_trade_server_online_cache", "Online order messages waiting for offline replay to complete.")
+	metricLastMessage   = newMetric("gauge", "openrisk_trade_server_last_message_timestamp_seconds", "Unix time of the last message received from trade server.")
+	metricPyCallSeconds = newMetric("histogram", "openrisk_python_call_seconds", "Duration of python call().", "module", "function")
+	metricAlerts        = newMetric("counter", "openrisk_risk_alerts_total", "Limit breach and recovery alerts.", "user", "portfolio", "status")
+)
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+func (m *Metric) get(labels []string) *metricValue {
+	key := labelKey(labels)
+	v := m.values[key]
+	if v == nil {
+		v = &metricValue{}
+		if m.Type == "histogram" {
+			v.Counts = make([]uint64, len(m.Buckets))
+		}
+		m.values[key] = v
+	}
+	return v
+}
+
+func (m *Metric) Add(delta float64, labels ...string) {
+	m.mutex.Lock()
+	m.get(labels).Value += delta
+	m.mutex.Unlock()
+}
+
+func (m *Metric) Set(value float64, labels ...string) {
+	m.mutex.Lock()
+	m.get(labels).Value = value
+	m.mutex.Unlock()
+}
+
+func (m *Metric) Observe(value float64, labels ...string) {
+	m.mutex.Lock()
+	v := m.get(labels)
+	for i, b := range m.Buckets {
+		if value <= b {
+			v.Counts[i]++
+		}
+	}
+	v.Sum += value
+	v.Count++
+	m.mutex.Unlock()
+}
+
+func (m *Metric) Since(tm time.Time, labels ...string) {
+	m.Observe(time.Since(tm).Seconds(), labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	var tmp []string
+	for i, name := range names {
+		tmp = append(tmp, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		tmp = append(tmp, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(tmp) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(tmp, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *Metric) WriteTo(buf *bytes.Buffer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := m.values[key]
+		var labels []string
+		if len(m.LabelNames) > 0 {
+			labels = strings.Split(key, "\x00")
+		}
+		if m.Type != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", m.Name, formatLabels(m.LabelNames, labels), formatFloat(v.Value))
+			continue
+		}
+		for i, b := range m.Buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", m.Name, formatLabels(m.LabelNames, labels, "le", formatFloat(b)), v.Counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", m.Name, formatLabels(m.LabelNames, labels, "le", "+Inf"), v.Count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", m.Name, formatLabels(m.LabelNames, labels), formatFloat(v.Sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", m.Name, formatLabels(m.LabelNames, labels), v.Count)
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	n := 0
+	loggedIn := 0
+	clients.Range(func(_, c interface{}) bool {
+		n++
+		if c.(*Client).UserId() > 0 {
+			loggedIn++
+		}
+		return true
+	})
+	metricClients.Set(float64(loggedIn), "true")
+	metricClients.Set(float64(n-loggedIn), "false")
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		m.WriteTo(&buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
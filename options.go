@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var riskFreeRate = flag.Float64("risk_free_rate", 0, "annual risk free rate for option pricing, e.g. 0.03")
+var impliedVol = flag.Float64("implied_vol", 0.3, "annual volatility for options without ImpliedVol in reference data")
+
+// option contract of a security, from the security message or reference data,
+// the latter taking precedence
+type OptionContract struct {
+	Strike   float64
+	Expiry   time.Time
+	Call     bool
+	Vol      float64
+	DivYield float64
+}
+
+func (s *Security) refString(name string) string {
+	switch v := getRefData().Attrs(s)[name].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// yyyymmdd or yyyy-mm-dd, expiring at the end of the day
+func parseExpiry(str string) (time.Time, bool) {
+	str = strings.Replace(str, "-", "", -1)
+	tm, err := time.ParseInLocation("20060102", str, time.Local)
+	if err != nil {
+		return tm, false
+	}
+	return tm.AddDate(0, 0, 1), true
+}
+
+// of the security itself, or reference data, e.g. for derivatives not sent with it
+func (s *Security) underlyingSymbol() string {
+	if v := s.refString("Underlying"); v != "" {
+		return v
+	}
+	return s.Underlying
+}
+
+// cached per security in the reference data it was read with, so that a
+// reload or resent security message reads it again
+func (s *Security) Option() (*OptionContract, bool) {
+	if s.underlying == nil {
+		return nil, false
+	}
+	r := getRefData()
+	if tmp, ok := r.options.Load(s.Id); ok && s.Id != 0 {
+		c, _ := tmp.(*OptionContract)
+		return c, c != nil
+	}
+	c, ok := s.readOption()
+	if !ok {
+		c = nil
+	}
+	if s.Id != 0 {
+		r.options.Store(s.Id, c)
+	}
+	return c, ok
+}
+
+func (s *Security) readOption() (*OptionContract, bool) {
+	c := &OptionContract{
+		Strike: s.Strike,
+		Vol:    *impliedVol,
+	}
+	if v, ok := s.refValue("Strike"); ok {
+		c.Strike = v
+	}
+	putCall := s.PutCall
+	if v := s.refString("PutCall"); v != "" {
+		putCall = v
+	}
+	expiry := s.Expiry
+	if v := s.refString("Expiry"); v != "" {
+		expiry = v
+	}
+	if v, ok := s.refValue("ImpliedVol"); ok {
+		c.Vol = v
+	}
+	if v, ok := s.refValue("DivYield"); ok {
+		c.DivYield = v
+	}
+	putCall = strings.ToUpper(putCall)
+	if c.Strike <= 0 || putCall == "" {
+		return nil, false
+	}
+	c.Call = putCall[0] == 'C'
+	tm, ok := parseExpiry(expiry)
+	if !ok {
+		return nil, false
+	}
+	c.Expiry = tm
+	return c, true
+}
+
+func normCdf(x float64) float64 {
+	return 0.5 * math.Erfc(-x/math.Sqrt2)
+}
+
+func normPdf(x float64) float64 {
+	return math.Exp(-x*x/2) / math.Sqrt(2*math.Pi)
+}
+
+type Greeks struct {
+	Price float64
+	Delta float64
+	Gamma float64
+	Vega  float64 // per 1% of volatility
+	Theta float64 // per calendar day
+}
+
+// Black-Scholes with dividend yield q, Black-76 on futures with q = r
+func blackScholes(call bool, spot float64, strike float64, t float64, r float64, q float64, vol float64) (g Greeks) {
+	if t <= 0 || vol <= 0 || spot <= 0 {
+		if call && spot > strike {
+			g.Price = spot - strike
+			g.Delta = 1
+		} else if !call && spot < strike {
+			g.Price = strike - spot
+			g.Delta = -1
+		}
+		return
+	}
+	sqrtT := math.Sqrt(t)
+	d1 := (math.Log(spot/strike) + (r-q+vol*vol/2)*t) / (vol * sqrtT)
+	d2 := d1 - vol*sqrtT
+	dq := math.Exp(-q * t)
+	dr := math.Exp(-r * t)
+	pdf := normPdf(d1)
+	g.Gamma = dq * pdf / (spot * vol * sqrtT)
+	g.Vega = spot * dq * pdf * sqrtT / 100
+	theta := -spot * dq * pdf * vol / (2 * sqrtT)
+	if call {
+		g.Price = spot*dq*normCdf(d1) - strike*dr*normCdf(d2)
+		g.Delta = dq * normCdf(d1)
+		theta += -r*strike*dr*normCdf(d2) + q*spot*dq*normCdf(d1)
+	} else {
+		g.Price = strike*dr*normCdf(-d2) - spot*dq*normCdf(-d1)
+		g.Delta = -dq * normCdf(-d1)
+		theta += r*strike*dr*normCdf(-d2) - q*spot*dq*normCdf(-d1)
+	}
+	g.Theta = theta / 365
+	return
+}
+
+func isFuture(s *Security) bool {
+	return strings.HasPrefix(strings.ToUpper(s.Type), "FUT")
+}
+
+// per unit of the underlying, nil for non-options
+func (s *Security) Greeks() *Greeks {
+	c, ok := s.Option()
+	if !ok {
+		return nil
+	}
+	t := c.Expiry.Sub(time.Now()).Hours() / 24 / 365
+	r := *riskFreeRate
+	q := c.DivYield
+	if isFuture(s.underlying) {
+		q = r
+	}
+	g := blackScholes(c.Call, s.underlying.GetClose(), c.Strike, t, r, q, c.Vol)
+	return &g
+}
+
+// price of the underlying for derivatives, of the security itself otherwise
+func (s *Security) UnderlyingClose() float64 {
+	if s.underlying != nil {
+		return s.underlying.GetClose()
+	}
+	return s.GetClose()
+}
+
+// symbol of the underlying, or of the security itself if it has none, so that
+// derivatives and cash positions roll up together
+func (s *Security) UnderlyingSymbol() string {
+	if s.underlying != nil {
+		return s.underlying.Symbol
+	}
+	if symbol := s.underlyingSymbol(); symbol != "" {
+		return symbol[strings.Index(symbol, ":")+1:]
+	}
+	return s.Symbol
+}
+
+// link to the underlying security, in the same market unless given as
+// market:symbol, else in the first market by name having the symbol, only on
+// the tradeServerJob goroutine
+func (s *Security) resolveUnderlying() *Security {
+	symbol := s.underlyingSymbol()
+	market := s.Market
+	explicit := false
+	if i := strings.Index(symbol, ":"); i > 0 {
+		market = symbol[:i]
+		symbol = symbol[i+1:]
+		explicit = true
+	}
+	if symbol == "" || (symbol == s.Symbol && market == s.Market) {
+		return nil
+	}
+	if u := SecurityMapByMarket[market][symbol]; u != nil || explicit {
+		return u
+	}
+	markets := make([]string, 0, len(SecurityMapByMarket))
+	for market := range SecurityMapByMarket {
+		markets = append(markets, market)
+	}
+	sort.Strings(markets)
+	for _, market := range markets {
+		if u := SecurityMapByMarket[market][symbol]; u != nil && u != s {
+			return u
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBlackScholes(t *testing.T) {
+	tests := []struct {
+		name                  string
+		call                  bool
+		spot, strike, t, r, q float64
+		vol                   float64
+		want                  Greeks
+	}{
+		{"call", true, 100, 100, 1, 0.05, 0, 0.2, Greeks{10.450584, 0.636831, 0.018762, 0.375240, -0.017573}},
+		{"put", false, 100, 100, 1, 0.05, 0, 0.2, Greeks{5.573526, -0.363169, 0.018762, 0.375240, -0.004542}},
+		{"itm call", true, 42, 40, 0.5, 0.1, 0, 0.2, Greeks{4.759422, 0.779131, 0.049963, 0.088134, -0.012491}},
+		{"otm put", false, 42, 40, 0.5, 0.1, 0, 0.2, Greeks{0.808599, -0.220869, 0.049963, 0.088134, -0.002066}},
+		// Black-76, futures underlying with q = r
+		{"black-76 call", true, 100, 100, 1, 0.05, 0.05, 0.2, Greeks{7.577082, 0.513500, 0.018880, 0.377593, -0.009307}},
+		{"black-76 put", false, 100, 95, 0.25, 0.05, 0.05, 0.3, Greeks{3.620327, -0.334152, 0.024079, 0.180593, -0.029191}},
+		// expired, intrinsic value only
+		{"expired call", true, 110, 100, 0, 0.05, 0, 0.2, Greeks{Price: 10, Delta: 1}},
+		{"expired put", false, 110, 100, -0.1, 0.05, 0, 0.2, Greeks{}},
+		{"zero vol put", false, 90, 100, 1, 0.05, 0, 0, Greeks{Price: 10, Delta: -1}},
+	}
+	for _, tt := range tests {
+		g := blackScholes(tt.call, tt.spot, tt.strike, tt.t, tt.r, tt.q, tt.vol)
+		got := []float64{g.Price, g.Delta, g.Gamma, g.Vega, g.Theta}
+		want := []float64{tt.want.Price, tt.want.Delta, tt.want.Gamma, tt.want.Vega, tt.want.Theta}
+		for i, name := range []string{"Price", "Delta", "Gamma", "Vega", "Theta"} {
+			if math.Abs(got[i]-want[i]) > 1e-6 {
+				t.Errorf("%s: %s = %.6f, want %.6f", tt.name, name, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		str  string
+		want string
+		ok   bool
+	}{
+		{"20240315", "2024-03-16", true},
+		{"2024-03-15", "2024-03-16", true},
+		{"2024-12-31", "2025-01-01", true},
+		{"202403", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		tm, ok := parseExpiry(tt.str)
+		if ok != tt.ok || (ok && tm.Format("2006-01-02") != tt.want) {
+			t.Errorf("parseExpiry(%q) = %v, %v, want %s, %v", tt.str, tm, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"strconv"
 	"strings"
 )
 
@@ -39,6 +40,14 @@ type Security struct {
 	IndustryGroup string
 	Industry      string
 	SubIndustry   string
+	// option contract, see Security.Option
+	Strike     float64
+	Expiry     string // yyyymmdd
+	PutCall    string // C or P
+	Underlying string // symbol in the same market or market:symbol
+	underlying *Security
+	MsgRate    float64            // Rate of the security message, see Security.updateRate
+	fxPairs    map[string]float64 // fx rates of the State copy, see Security.getFxPairs
 	MD
 }
 
@@ -75,6 +84,18 @@ func ParseSecurity(msg []interface{}) {
 		Sedol:         msg[18].(string),
 		Isin:          msg[19].(string),
 	}
+	// optional option contract fields
+	if len(msg) > 23 {
+		sec.Strike, _ = msg[20].(float64)
+		switch v := msg[21].(type) {
+		case string:
+			sec.Expiry = v
+		case float64:
+			sec.Expiry = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		sec.PutCall, _ = msg[22].(string)
+		sec.Underlying, _ = msg[23].(string)
+	}
 	if sec.Market == "CURRENCY" {
 		sec.Market = "FX"
 	}
@@ -84,19 +105,34 @@ func ParseSecurity(msg []interface{}) {
 	if sec.Rate <= 0 {
 		sec.Rate = 1
 	}
+	sec.MsgRate = sec.Rate
+	if old := SecurityMapById[sec.Id]; old != nil {
+		// resent after reconnect, update in place so positions keep pointing to it
+		sec.MD = old.MD
+		getRefData().options.Delete(sec.Id)
+		getRefData().cache.Delete(sec.Id)
+		delete(securitiesByCurrency[old.Currency], old.Id)
+		*old = *sec
+		sec = old
+	}
 	SecurityMapById[sec.Id] = sec
+	indexCurrency(sec)
 	tmp := SecurityMapByMarket[sec.Market]
 	if tmp == nil {
 		tmp = make(map[string]*Security)
 		SecurityMapByMarket[sec.Market] = tmp
 	}
 	tmp[sec.Symbol] = sec
+	if isFxSecurity(sec) {
+		fxSecurities[sec.Id] = true
+	}
+	sec.updateRate()
 }
 
 type Order struct {
 	Id          int64
 	OrigClOrdId int64
-	// Tm int64
+	Tm          int64 // of the last message
 	// Seq int64
 	St       string
 	Security *Security
@@ -107,10 +143,11 @@ type Order struct {
 	Side string
 	Type string
 	// Tif string
-	CumQty  float64
-	AvgPx   float64
-	LastQty float64
-	LastPx  float64
+	CumQty      float64
+	AvgPx       float64
+	LastQty     float64
+	LastPx      float64
+	LastTradeId string
 }
 
 var orders = make(map[int64]*Order)
@@ -130,13 +167,33 @@ type Position struct {
 	BuyValue        float64
 	SellQty         float64
 	SellValue       float64
+	Lots            []Lot  // open lots, shared by copies, see tradeLots
+	Fills           []Fill // since bod, see Position.rebuild
+	LotMethod       string // Lots, AvgPx and RealizedPnl were derived with, see Position.fill
 	Security        *Security
 	Acc             int
+	AccName         string
+	seq             int64 // of the State copy, see copyState
+	changedSeq      int64 // seq of the last State copy taken after the position changed
 }
 
 var Positions = make(map[int]map[int64]*Position)
 var usedSecurities = make(map[int64]bool)
 
+// changes since last risk evaluation, handed over to it by TakeState
+var dirtyAccs = make(map[int]bool)
+var dirtySecurities = make(map[int64]bool)
+var dirtyWindows = false
+var allDirty = true
+
+func MarkAllDirty() {
+	allDirty = true
+}
+
+func IsDirty() bool {
+	return allDirty || dirtyWindows || dirtyFx || len(dirtyAccs) > 0 || len(dirtySecurities) > 0
+}
+
 func getPos(acc int, securityId int64) *Position {
 	tmp := Positions[acc]
 	if tmp == nil {
@@ -147,6 +204,7 @@ func getPos(acc int, securityId int64) *Position {
 	if p == nil {
 		p = &Position{}
 		p.Acc = acc
+		p.AccName = AccNames[acc]
 		p.Security = SecurityMapById[securityId]
 		if p.Security == nil {
 			log.Println("unknown securityId", securityId)
@@ -171,8 +229,12 @@ func isLive(st string) bool {
 }
 
 func updatePos(ord *Order) {
-	securityId := ord.Security.Id
-	p := getPos(ord.Acc, securityId)
+	p := getPos(ord.Acc, ord.Security.Id)
+	p.update(ord)
+	dirtyAccs[ord.Acc] = true
+}
+
+func (p *Position) update(ord *Order) {
 	var outstand *float64
 	if ord.Side == "buy" {
 		outstand = &p.OutstandBuyQty
@@ -187,7 +249,7 @@ func updatePos(ord *Order) {
 		if ord.LastQty > 0 && ord.Type != "otc" {
 			*outstand -= ord.LastQty
 			if *outstand < 0 {
-				log.Printf("Outstand < 0: %s", ord)
+				log.Printf("Outstand < 0: %+v", ord)
 				*outstand = 0
 			}
 		}
@@ -200,32 +262,27 @@ func updatePos(ord *Order) {
 			p.SellQty += ord.LastQty
 			p.SellValue += ord.LastQty * ord.LastPx
 		}
-		qty0 := p.Qty
-		px := ord.LastPx
-		multiplier := ord.Security.Rate * ord.Security.Multiplier
-		if (qty0 > 0) && (qty < 0) { // sell trade to cover position
-			if qty0 > -qty {
-				p.RealizedPnl += (px - p.AvgPx) * -qty * multiplier
-			} else {
-				p.RealizedPnl += (px - p.AvgPx) * qty0 * multiplier
-				p.AvgPx = px
-			}
-		} else if (qty0 < 0) && (qty > 0) { // buy trade to cover position
-			if -qty0 > qty {
-				p.RealizedPnl += (p.AvgPx - px) * qty * multiplier
-			} else {
-				p.RealizedPnl += (p.AvgPx - px) * -qty0 * multiplier
-				p.AvgPx = px
+		f := Fill{
+			OrderId:    ord.Id,
+			TradeId:    ord.LastTradeId,
+			Tm:         ord.Tm,
+			Qty:        qty,
+			Px:         ord.LastPx,
+			Multiplier: ord.Security.Rate * ord.Security.Multiplier,
+		}
+		if ord.LastQty < 0 {
+			if p.bust(f) {
+				return
 			}
-		} else { // open position
-			p.AvgPx = (qty0*p.AvgPx + qty*px) / (qty0 + qty)
+			log.Printf("busted trade not found: %+v", ord)
 		}
-		p.Qty += qty
+		p.Fills = append(p.Fills, f)
+		p.fill(f, lotMethod(p.AccName))
 
 	default:
 		*outstand -= ord.Qty - ord.CumQty
 		if *outstand < 0 {
-			log.Printf("Outstand < 0: %s", ord)
+			log.Printf("Outstand < 0: %+v", ord)
 			*outstand = 0
 		}
 	}
@@ -233,8 +290,35 @@ func updatePos(ord *Order) {
 
 var seqNum int64 = 0
 var offlineDone = false
+var bodDone = false
 var onlineCache [][]interface{}
 
+// ResetSession is called on every (re)connection to trade server, the
+// positions already built are kept and only messages after seqNum are applied,
+// unless bod and offline replay did not complete, in which case bod is
+// requested again and orders are replayed from the start
+func ResetSession() {
+	offlineDone = false
+	if !bodDone {
+		seqNum = 0
+		Positions = make(map[int]map[int64]*Position)
+		orders = make(map[int64]*Order)
+	}
+	onlineCache = onlineCache[:0]
+	allDirty = true
+}
+
+func Resubscribe() {
+	for securityId := range usedSecurities {
+		Request([]interface{}{"sub", securityId})
+	}
+	for securityId := range fxSecurities {
+		if !usedSecurities[securityId] {
+			Request([]interface{}{"sub", securityId})
+		}
+	}
+}
+
 func ParseOffline(msg []interface{}) {
 	if msg[1].(string) == "complete" {
 		for _, msg := range onlineCache {
@@ -242,6 +326,7 @@ func ParseOffline(msg []interface{}) {
 		}
 		onlineCache = onlineCache[:0]
 		offlineDone = true
+		bodDone = true
 		log.Print("offline done")
 	}
 }
@@ -252,7 +337,7 @@ func ParseOrder(msg []interface{}, isOnline bool) {
 		return
 	}
 	clOrdId := int64(msg[1].(float64))
-	// tm := int64(msg[2].(float64))
+	tm := int64(msg[2].(float64))
 	seq := int64(msg[3].(float64))
 	if seq <= seqNum {
 		return
@@ -277,6 +362,7 @@ func ParseOrder(msg []interface{}, isOnline bool) {
 		// tif := msg[14].(string)
 		ord := Order{
 			Id:       clOrdId,
+			Tm:       tm,
 			St:       st,
 			Security: security,
 			Acc:      acc,
@@ -293,7 +379,7 @@ func ParseOrder(msg []interface{}, isOnline bool) {
 	case "filled", "partial":
 		qty := msg[5].(float64)
 		px := msg[6].(float64)
-		// tradeId = msg[7].(string)
+		tradeId, _ := msg[7].(string)
 		execTransType := msg[8].(string)
 		if execTransType == "cancel" {
 			qty = -qty
@@ -307,6 +393,8 @@ func ParseOrder(msg []interface{}, isOnline bool) {
 			}
 			ord.LastQty = qty
 			ord.LastPx = px
+			ord.LastTradeId = tradeId
+			ord.Tm = tm
 			if ord.CumQty >= ord.Qty {
 				st = "filled"
 			} else {
@@ -379,6 +467,12 @@ func ParseBod(msg []interface{}) {
 	p.Bod.Qty = qty
 	p.Bod.AvgPx = avgPx
 	p.Bod.RealizedPnl = realizedPnl
+	p.Lots = nil
+	if qty != 0 {
+		p.Lots = []Lot{{Qty: qty, Px: avgPx}}
+	}
+	p.Fills = nil
+	dirtyAccs[acc] = true
 }
 
 func ParseMd(msg []interface{}) {
@@ -393,6 +487,9 @@ func ParseMd(msg []interface{}) {
 				log.Println("unknown security id", securityId)
 				continue
 			}
+			if usedSecurities[securityId] {
+				dirtySecurities[securityId] = true
+			}
 			switch k {
 			case "o":
 				s.Open = v
@@ -402,6 +499,9 @@ func ParseMd(msg []interface{}) {
 				s.Low = v
 			case "c":
 				s.Close = v
+				if isFxSecurity(s) {
+					onFxTick(s)
+				}
 			case "q":
 				s.Qty = v
 			case "v":
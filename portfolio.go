@@ -10,19 +10,26 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Portfolio struct {
-	Name        string
-	RiskDefs    []*RiskDef
-	AccPatterns string
-	Filter      *Expression
+	UserId        int
+	Name          string
+	RiskDefs      []*RiskDef
+	AccPatterns   string
+	Filter        *Expression
+	ScenarioNames []string // see Portfolio.scenarios
+	Currency      string   // Rate converts into, reporting currency if empty
+	UsesFx        bool     // Currency is set or RateTo is used
 }
 
 func ParsePortfolio(cfg *IniSection, path string) (p *Portfolio, eres error) {
 	p = &Portfolio{
-		Name:        cfg.ValueMap["name"][0],
-		AccPatterns: cfg.ValueMap["acc"][0],
+		Name:          cfg.ValueMap["name"][0],
+		AccPatterns:   cfg.ValueMap["acc"][0],
+		ScenarioNames: split(cfg.ValueMap["scenarios"][0], ","),
+		Currency:      strings.ToUpper(cfg.ValueMap["currency"][0]),
 	}
 	for _, r := range cfg.Sections {
 		rd, err := newRiskDef(r, path)
@@ -30,6 +37,7 @@ func ParsePortfolio(cfg *IniSection, path string) (p *Portfolio, eres error) {
 			eres = err
 			return
 		}
+		rd.Portfolio = p
 		p.RiskDefs = append(p.RiskDefs, rd)
 	}
 	f := cfg.ValueMap["filter"]
@@ -41,9 +49,62 @@ func ParsePortfolio(cfg *IniSection, path string) (p *Portfolio, eres error) {
 		}
 		p.Filter = res
 	}
+	vars := make(map[string]bool)
+	p.vars(vars)
+	p.UsesFx = p.Currency != "" || vars[fxParam]
 	return
 }
 
+// variables used by the expressions of p
+func (p *Portfolio) vars(out map[string]bool) {
+	p.Filter.vars(out)
+	for _, riskDef := range p.RiskDefs {
+		riskDef.Filter.vars(out)
+		for _, g := range riskDef.Groups {
+			groupVars(g, out)
+		}
+		for _, rp := range riskDef.Params {
+			rp.Formula.vars(out)
+			for _, v := range rp.Variables {
+				v.E.vars(out)
+			}
+		}
+	}
+}
+
+func groupVars(g interface{}, out map[string]bool) {
+	switch v := g.(type) {
+	case *Expression:
+		v.vars(out)
+	case *GroupKey:
+		v.E.vars(out)
+	case []interface{}:
+		for _, level := range v {
+			groupVars(level, out)
+		}
+	}
+}
+
+// call reload on change of any of the comma separated files, and
+// re-evaluate everything afterwards. reload returns false if it could not be
+// applied yet, e.g. trade server not connected, to be retried on next check.
+func watchFiles(files string, reload func() bool) {
+	mtimes := modTimes(files)
+	for range time.Tick(refDataCheckInterval) {
+		tmp := modTimes(files)
+		changed := false
+		for fn, tm := range tmp {
+			if !tm.Equal(mtimes[fn]) {
+				changed = true
+			}
+		}
+		if changed && reload() {
+			mtimes = tmp
+			onJob(MarkAllDirty)
+		}
+	}
+}
+
 var UserIdAccs = make(map[int][]int)
 var AccNames = make(map[int]string)
 
@@ -52,6 +113,15 @@ func ParseUserIdAcc(msg []interface{}) {
 	acc := int(msg[2].(float64))
 	accName := msg[3].(string)
 	AccNames[acc] = accName
+	for _, p := range Positions[acc] {
+		// positions created before the name arrived were booked with the lot
+		// method of the empty name
+		p.AccName = accName
+		if p.LotMethod != "" && p.LotMethod != lotMethod(accName) {
+			p.rebuild()
+			dirtyAccs[acc] = true
+		}
+	}
 	action := ""
 	if len(msg) > 4 {
 		action = msg[4].(string)
@@ -68,20 +138,79 @@ func ParseUserIdAcc(msg []interface{}) {
 		}
 	}
 	parsePortfolios(userId)
+	allDirty = true
+}
+
+func (p *Portfolio) FindParam(riskName string, paramName string) *RiskParamDef {
+	for _, r := range p.RiskDefs {
+		if riskName == r.DisplayName {
+			for _, rp := range r.Params {
+				if rp.Name == paramName {
+					return rp
+				}
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// risks nil to run all, risks under scenarios are reported as <risk>@<scenario>
+// values of the risks given, nil for all, with risk@scenario for the portfolio's scenarios
+func (p *Portfolio) Run(positions []*Position, risks map[string]bool) map[string]interface{} {
+	return p.run(positions, risks, (*RiskDef).Run)
+}
+
+// same as Run without side effects, see RiskDef.Peek
+func (p *Portfolio) Peek(positions []*Position, risks map[string]bool) map[string]interface{} {
+	return p.run(positions, risks, (*RiskDef).Peek)
 }
 
-func (p *Portfolio) Run(positions []*Position) map[string]interface{} {
+func (p *Portfolio) run(positions []*Position, risks map[string]bool, run func(*RiskDef, []*Position) interface{}) map[string]interface{} {
 	rpt := make(map[string]interface{})
 	for _, riskDef := range p.RiskDefs {
 		name := riskDef.DisplayName
-		tmp := riskDef.Run(positions)
+		if risks != nil && !risks[name] {
+			continue
+		}
+		tmp := run(riskDef, positions)
 		if tmp != nil {
 			rpt[name] = tmp
 		}
 	}
+	for _, sc := range p.scenarios() {
+		var shocked []*Position
+		for _, riskDef := range p.RiskDefs {
+			name := riskDef.DisplayName + "@" + sc.Name
+			if risks != nil && !risks[name] {
+				continue
+			}
+			if shocked == nil {
+				shocked = sc.Apply(positions, p.rateCurrency())
+			}
+			tmp := riskDef.RunScenario(shocked)
+			if tmp != nil {
+				rpt[name] = tmp
+			}
+		}
+	}
 	return rpt
 }
 
+// names of the risks reported by Run
+func (p *Portfolio) riskNames() []string {
+	var out []string
+	for _, riskDef := range p.RiskDefs {
+		out = append(out, riskDef.DisplayName)
+	}
+	for _, sc := range p.scenarios() {
+		for _, riskDef := range p.RiskDefs {
+			out = append(out, riskDef.DisplayName+"@"+sc.Name)
+		}
+	}
+	return out
+}
+
 func copy(from string, to string) error {
 	data, err := ioutil.ReadFile(from)
 	if err != nil {
@@ -150,6 +279,8 @@ func parsePortfolios(userId int) {
 			if portfolio.AccPatterns == "" {
 				portfolio.AccPatterns = "*"
 			}
+			portfolio.UserId = userId
+			portfolio.loadHistory()
 			m[portfolio.Name] = portfolio
 		}
 	}
@@ -192,8 +323,7 @@ func DeleteFile(userId int, fn string) error {
 	if path.Ext(fn) == ".py" {
 		os.Remove(path.Join(GetPath(userId), fn+"c"))
 	}
-	delete(UserPortfolios, userId)
-	parsePortfolios(userId)
+	reloadPortfolios(userId)
 	return err
 }
 
@@ -203,12 +333,20 @@ func SaveFile(userId int, fn string, content string) error {
 	if path.Ext(fn) == ".py" {
 		RestartPy()
 	}
+	reloadPortfolios(userId)
+	return err
+}
+
+func reloadPortfolios(userId int) {
+	for _, p := range UserPortfolios[userId] {
+		p.flushHistory(true)
+	}
 	delete(UserPortfolios, userId)
 	parsePortfolios(userId)
-	return err
+	allDirty = true
 }
 
-func getAccMatch(patternsStr string, values []int) []int {
+func getAccMatch(patternsStr string, values []int, accNames map[int]string) []int {
 	res := make([]int, 0, len(values))
 	if patternsStr != "" {
 		if patternsStr[0] == '~' {
@@ -224,7 +362,7 @@ func getAccMatch(patternsStr string, values []int) []int {
 			p = p[1:]
 		}
 		for _, v := range values {
-			name := AccNames[v]
+			name := accNames[v]
 			matched, _ := filepath.Match(p, name)
 			if !matched {
 				continue
@@ -246,39 +384,64 @@ func getAccMatch(patternsStr string, values []int) []int {
 	return res
 }
 
-func RunUserPortfolios() map[int]map[string]interface{} {
+func (p *Portfolio) filter(pos *Position) bool {
+	if p.Filter != nil {
+		v, _ := Evaluate(p.Filter, pos)
+		if v2, ok2 := v.(bool); ok2 {
+			return v2
+		}
+	}
+	return true
+}
+
+func (p *Portfolio) getPositions(state *State, accs []int) []*Position {
+	var positions []*Position
+	for _, acc := range getAccMatch(p.AccPatterns, accs, state.AccNames) {
+		for _, pos := range state.Positions[acc] {
+			if p.filter(pos) {
+				positions = append(positions, pos)
+			}
+		}
+	}
+	// copies marked changed on fx changes even without currency for RateTo
+	if p.Currency != "" || (p.UsesFx && state.DirtyFx) {
+		positions = convertRates(positions, p.Currency, state.FxPairs, state.DirtyFx)
+	}
+	return positions
+}
+
+// evaluate on a State taken by TakeState, safe to run along with tradeServerJob
+func RunUserPortfolios(state *State) map[int]map[string]interface{} {
 	out := make(map[int]map[string]interface{})
+	LoadPyExposures(state)
 	var wg sync.WaitGroup
-	wg.Add(len(UserIdAccs))
-	for userId, accs := range UserIdAccs {
+	wg.Add(len(state.UserIdAccs))
+	for userId, accs := range state.UserIdAccs {
 		rpt := make(map[string]interface{})
 		out[userId] = rpt
-		go func() {
+		go func(userId int, accs []int) {
 			defer wg.Done()
-			for _, p := range UserPortfolios[userId] {
-				usedAccs := getAccMatch(p.AccPatterns, accs)
-				var positions []*Position
-				if len(usedAccs) > 0 {
-					for _, acc := range usedAccs {
-						tmp := Positions[acc]
-						for _, tmp2 := range tmp {
-							if p.Filter != nil {
-								v, _ := Evaluate(p.Filter, tmp2)
-								if v2, ok2 := v.(bool); ok2 {
-									if !v2 {
-										continue
-									}
-								}
-							}
-							positions = append(positions, tmp2)
-						}
+			for _, p := range state.UserPortfolios[userId] {
+				risks := state.risksToRun(userId, p)
+				if risks != nil && len(risks) == 0 {
+					continue
+				}
+				if !state.isDirty(p, accs) {
+					if tmp, ok := state.Previous[userId][p.Name]; ok {
+						rpt[p.Name] = tmp
 					}
+					continue
 				}
+				positions := p.getPositions(state, accs)
+				user := strconv.Itoa(userId)
+				metricPositions.Set(float64(len(positions)), user, p.Name)
 				if len(positions) > 0 {
-					rpt[p.Name] = p.Run(positions)
+					tm := time.Now()
+					rpt[p.Name] = p.Run(positions, risks)
+					metricEvalSeconds.Since(tm, user, p.Name)
 				}
 			}
-		}()
+		}(userId, accs)
 	}
 	wg.Wait()
 	return out
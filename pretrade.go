@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"github.com/thoas/go-funk"
+	"math"
+	"time"
+)
+
+// apply proposed order to a copy of its position, assuming it is fully filled at px
+func hypotheticalPos(acc int, security *Security, side string, qty float64, px float64) *Position {
+	p := &Position{Acc: acc, AccName: AccNames[acc], Security: security}
+	if tmp := Positions[acc][security.Id]; tmp != nil {
+		*p = *tmp
+		// not to append into the spare capacity shared with the live position
+		p.Fills = p.Fills[:len(p.Fills):len(p.Fills)]
+	}
+	ord := &Order{
+		St:       "unconfirmed",
+		Security: security,
+		Acc:      acc,
+		Qty:      qty,
+		Px:       px,
+		Side:     side,
+	}
+	p.update(ord)
+	ord.St = "filled"
+	ord.CumQty = qty
+	ord.AvgPx = px
+	ord.LastQty = qty
+	ord.LastPx = px
+	p.update(ord)
+	return p
+}
+
+func (self *RiskParamDef) checkValue(key string, positions []*Position, now float64) float64 {
+	if len(positions) == 0 {
+		return math.NaN()
+	}
+	v, ok := self.value(positions).(float64)
+	if !ok {
+		return math.NaN()
+	}
+	if self.Window.Seconds > 0 {
+		v = self.peekWindow(key, now, v)
+	}
+	return v
+}
+
+func containsPos(positions []*Position, pos *Position) bool {
+	for _, p := range positions {
+		if p == pos {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrder re-evaluates the bounded risk params of all portfolios covering acc
+// with the order applied, and returns the bounds it would newly violate or
+// violate further. Breaches the order reduces are not reported. Violations of
+// portfolios of users other than userId only tell the bound, not the portfolio.
+func CheckOrder(userId int, acc int, security *Security, side string, qty float64, px float64) []*RiskAlert {
+	hypothetical := hypotheticalPos(acc, security, side, qty, px)
+	now := float64(time.Now().Unix())
+	state := liveState()
+	var out []*RiskAlert
+	for owner, accs := range UserIdAccs {
+		if funk.IndexOf(accs, acc) < 0 {
+			continue
+		}
+		for _, p := range UserPortfolios[owner] {
+			if len(getAccMatch(p.AccPatterns, []int{acc}, AccNames)) == 0 || !p.filter(hypothetical) {
+				continue
+			}
+			pos := hypothetical
+			if p.Currency != "" {
+				pos = convertRates([]*Position{pos}, p.Currency, state.FxPairs, false)[0]
+			}
+			var before, after []*Position
+			for _, riskDef := range p.RiskDefs {
+				var params []*RiskParamDef
+				for _, rp := range riskDef.Params {
+					if rp.HasBounds() {
+						params = append(params, rp)
+					}
+				}
+				if len(params) == 0 {
+					continue
+				}
+				if before == nil {
+					before = p.getPositions(state, accs)
+					after = make([]*Position, 0, len(before)+1)
+					// positions may be copies, see Portfolio.getPositions
+					for _, tmp := range before {
+						if tmp.Acc != acc || tmp.Security.Id != security.Id {
+							after = append(after, tmp)
+						}
+					}
+					after = append(after, pos)
+				}
+				groupingsBefore := riskDef.group(before)
+				for i, g := range riskDef.group(after) {
+					for gname, positions := range g.Positions {
+						if !containsPos(positions, pos) {
+							continue
+						}
+						key := groupStateKey(i, gname)
+						for _, rp := range params {
+							v := rp.checkValue(key, positions, now)
+							bound, limit := rp.violatedBound(v)
+							if bound == "" {
+								continue
+							}
+							v0 := rp.checkValue(key, groupingsBefore[i].Positions[gname], now)
+							bound0, _ := rp.violatedBound(v0)
+							if bound0 == bound && math.Abs(v-limit) <= math.Abs(v0-limit) {
+								continue
+							}
+							alert := &RiskAlert{
+								UserId: owner,
+								Status: "reject",
+								Bound:  bound,
+								Tm:     int64(now),
+							}
+							if owner == userId {
+								alert.Portfolio = p.Name
+								alert.Risk = riskDef.DisplayName
+								alert.Param = rp.Name
+								alert.Group = gname
+								alert.Limit = limit
+								alert.Value = v
+							}
+							out = append(out, alert)
+						}
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// ["preTrade", id, acc, securityId, side, qty, px]
+func PreTrade(userId int, msg []interface{}) []interface{} {
+	out := []interface{}{"preTrade", msg[1]}
+	if len(msg) < 7 {
+		return append(out, "error", "expect: preTrade, id, acc, securityId, side, qty, px")
+	}
+	acc, _ := msg[2].(float64)
+	securityId, _ := msg[3].(float64)
+	side, _ := msg[4].(string)
+	qty, _ := msg[5].(float64)
+	px, _ := msg[6].(float64)
+	status, res := preTrade(userId, int(acc), int64(securityId), side, qty, px)
+	if res == nil {
+		return append(out, status)
+	}
+	return append(out, status, res)
+}
+
+// "accept", "reject" with violations, or "error" with the reason, only for
+// accounts of userId
+func preTrade(userId int, acc int, securityId int64, side string, qty float64, px float64) (string, interface{}) {
+	if funk.IndexOf(UserIdAccs[userId], acc) < 0 {
+		return "error", fmt.Sprintf("account %d not found", acc)
+	}
+	security := SecurityMapById[securityId]
+	if security == nil {
+		return "error", fmt.Sprintf("unknown security id %v", securityId)
+	}
+	if side != "buy" && side != "sell" && side != "short" {
+		return "error", "invalid side: " + side
+	}
+	if qty <= 0 {
+		return "error", "invalid qty"
+	}
+	if px <= 0 {
+		px = security.GetClose()
+	}
+	violations := CheckOrder(userId, acc, security, side, qty, px)
+	if len(violations) > 0 {
+		return "reject", violations
+	}
+	return "accept", nil
+}
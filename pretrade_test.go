@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+// both users cover account 7, which holds 20@10 breaching the upper bound of
+// 100 of user 7 but not that of 220 of user 8
+func TestCheckOrder(t *testing.T) {
+	const acc = 7
+	bounds := map[int]string{7: "100", 8: "220"}
+	for userId, bound := range bounds {
+		cfg, err := ParseIni("[gross]\nformula=sum(Pos*Close)\nupper_bound=" + bound + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		portfolio, err := ParsePortfolio(cfg, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		portfolio.Name = "pt"
+		portfolio.AccPatterns = "*"
+		portfolio.UserId = userId
+		UserPortfolios[userId] = map[string]*Portfolio{portfolio.Name: portfolio}
+		UserIdAccs[userId] = []int{acc}
+	}
+	AccNames[acc] = "PT7"
+	s := &Security{Id: 701, Multiplier: 1, Rate: 1}
+	s.Close = 10
+	p := &Position{Acc: acc, AccName: AccNames[acc], Security: s}
+	p.Qty = 20
+	Positions[acc] = map[int64]*Position{s.Id: p}
+	defer func() {
+		for userId := range bounds {
+			delete(UserPortfolios, userId)
+			delete(UserIdAccs, userId)
+		}
+		delete(AccNames, acc)
+		delete(Positions, acc)
+	}()
+	tests := []struct {
+		side   string
+		qty    float64
+		owners []int
+	}{
+		{"sell", 5, nil},
+		{"buy", 1, []int{7}},
+		{"buy", 5, []int{7, 8}},
+	}
+	for _, tt := range tests {
+		alerts := CheckOrder(7, acc, s, tt.side, tt.qty, 10)
+		if len(alerts) != len(tt.owners) {
+			t.Errorf("%s %v: %d alerts, want %d", tt.side, tt.qty, len(alerts), len(tt.owners))
+			continue
+		}
+		for _, alert := range alerts {
+			if alert.Status != "reject" || alert.Bound != "upper" {
+				t.Errorf("%s %v: alert %+v", tt.side, tt.qty, alert)
+			}
+			if alert.UserId == 7 && (alert.Portfolio != "pt" || alert.Limit != 100 || alert.Value != 200+10*tt.qty) {
+				t.Errorf("%s %v: own alert %+v", tt.side, tt.qty, alert)
+			}
+			if alert.UserId == 8 && (alert.Portfolio != "" || alert.Risk != "" || alert.Limit != 0 || alert.Value != 0) {
+				t.Errorf("%s %v: other owner's details not hidden: %+v", tt.side, tt.qty, alert)
+			}
+		}
+	}
+	// the live position is left alone
+	if p.Qty != 20 || len(p.Fills) != 0 {
+		t.Errorf("position modified: qty %v fills %v", p.Qty, p.Fills)
+	}
+}
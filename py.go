@@ -8,6 +8,8 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"sync"
+	"time"
 )
 
 var pySymbol = python.PyString_FromString("Symbol")
@@ -49,6 +51,15 @@ var pyBuyQty = python.PyString_FromString("BuyQty")
 var pySellQty = python.PyString_FromString("SellQty")
 var pyBuyValue = python.PyString_FromString("BuyValue")
 var pySellValue = python.PyString_FromString("SellValue")
+var pyBeta = python.PyString_FromString("Beta")
+var pyDelta = python.PyString_FromString("Delta")
+var pyGamma = python.PyString_FromString("Gamma")
+var pyVega = python.PyString_FromString("Vega")
+var pyTheta = python.PyString_FromString("Theta")
+var pyUnderlyingClose = python.PyString_FromString("UnderlyingClose")
+var pyUnderlying = python.PyString_FromString("Underlying")
+var pyDeltaQty = python.PyString_FromString("DeltaQty")
+var pyLots = python.PyString_FromString("Lots")
 
 func (p *Position) ToPy() *python.PyObject {
 	out := python.PyDict_New()
@@ -84,8 +95,7 @@ func (p *Position) ToPy() *python.PyObject {
 	python.PyDict_SetItem(out, pyBidSize, python.PyFloat_FromDouble(s.BidSize))
 	python.PyDict_SetItem(out, pyOutstandBuyQty, python.PyFloat_FromDouble(p.OutstandBuyQty))
 	python.PyDict_SetItem(out, pyOutstandSellQty, python.PyFloat_FromDouble(p.OutstandSellQty))
-	name := AccNames[p.Acc]
-	python.PyDict_SetItem(out, pyAcc, python.PyString_FromString(name))
+	python.PyDict_SetItem(out, pyAcc, python.PyString_FromString(p.AccName))
 	python.PyDict_SetItem(out, pyPos, python.PyFloat_FromDouble(p.Qty))
 	python.PyDict_SetItem(out, pyAvgPx, python.PyFloat_FromDouble(p.AvgPx))
 	python.PyDict_SetItem(out, pyRealizedPnl, python.PyFloat_FromDouble(p.RealizedPnl))
@@ -94,6 +104,41 @@ func (p *Position) ToPy() *python.PyObject {
 	python.PyDict_SetItem(out, pySellQty, python.PyFloat_FromDouble(p.SellQty))
 	python.PyDict_SetItem(out, pyBuyValue, python.PyFloat_FromDouble(p.BuyValue))
 	python.PyDict_SetItem(out, pySellValue, python.PyFloat_FromDouble(p.SellValue))
+	r := getRefData()
+	attrs := r.Attrs(s)
+	for name, v := range r.Defaults {
+		if tmp, ok := attrs[name]; ok {
+			v = tmp
+		}
+		switch v2 := v.(type) {
+		case float64:
+			python.PyDict_SetItemString(out, name, python.PyFloat_FromDouble(v2))
+		case string:
+			python.PyDict_SetItemString(out, name, python.PyString_FromString(v2))
+		}
+	}
+	python.PyDict_SetItem(out, pyBeta, python.PyFloat_FromDouble(s.GetBeta()))
+	python.PyDict_SetItem(out, pyDelta, python.PyFloat_FromDouble(s.GetDelta()))
+	var greeks Greeks
+	if g := s.Greeks(); g != nil {
+		greeks = *g
+	}
+	python.PyDict_SetItem(out, pyGamma, python.PyFloat_FromDouble(greeks.Gamma))
+	python.PyDict_SetItem(out, pyVega, python.PyFloat_FromDouble(greeks.Vega))
+	python.PyDict_SetItem(out, pyTheta, python.PyFloat_FromDouble(greeks.Theta))
+	python.PyDict_SetItem(out, pyUnderlyingClose, python.PyFloat_FromDouble(s.UnderlyingClose()))
+	python.PyDict_SetItem(out, pyUnderlying, python.PyString_FromString(s.UnderlyingSymbol()))
+	python.PyDict_SetItem(out, pyDeltaQty, python.PyFloat_FromDouble(p.DeltaQty()))
+	// [(tm, qty, px), ...]
+	lots := python.PyList_New(len(p.Lots))
+	for i, lot := range p.Lots {
+		tmp := python.PyTuple_New(3)
+		python.PyTuple_SetItem(tmp, 0, python.PyLong_FromLongLong(lot.Tm))
+		python.PyTuple_SetItem(tmp, 1, python.PyFloat_FromDouble(lot.Qty))
+		python.PyTuple_SetItem(tmp, 2, python.PyFloat_FromDouble(lot.Px))
+		python.PyList_SetItem(lots, i, tmp)
+	}
+	python.PyDict_SetItem(out, pyLots, lots)
 
 	return out
 }
@@ -106,12 +151,21 @@ func InitPy() {
 	}
 }
 
+// go-python does not manage the GIL, so only one goroutine may use the interpreter at a time
+var pyMutex sync.Mutex
+
 func RestartPy() {
+	pyMutex.Lock()
+	defer pyMutex.Unlock()
 	python.Finalize()
 	InitPy()
+	clearPyExposures()
 }
 
 func CallPy(moduleName string, funcName string, strArgs string, positions []*Position, mpath string) (res interface{}, eres error) {
+	defer metricPyCallSeconds.Since(time.Now(), moduleName, funcName)
+	pyMutex.Lock()
+	defer pyMutex.Unlock()
 	if mpath != "" {
 		_, err := os.Stat(path.Join(mpath, moduleName+".py"))
 		if err == nil {
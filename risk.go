@@ -1,12 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"github.com/thoas/go-funk"
 	"log"
 	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,7 @@ var predefinedGroupName = []string{
 	"type",
 	"currency",
 	"acc",
+	"underlying",
 }
 
 const (
@@ -28,6 +31,7 @@ const (
 	GROUP_TYPE        = 4
 	GROUP_CURRENCY    = 5
 	GROUP_ACC         = 6
+	GROUP_UNDERLYING  = 7
 )
 
 type WindowDef struct {
@@ -49,10 +53,21 @@ type RiskParamDef struct {
 	Window     WindowDef
 	Variables  []NameExpression
 	Graph      bool
-	History    map[string][][2]float64 // only if Graph = true
+	History    map[string][][2]float64 // by group state key, only if Graph = true
+	// history settings in seconds, tolerance is the relative move required for a new point
+	HistoryRetention  float64
+	HistoryResolution float64
+	HistoryTolerance  float64
+	savedHistory      map[string]float64     // time of the last point written to the history file by group state key
+	Breaches          map[string]*RiskAlert  // active bound breaches by group state key
+	Windows           map[string]*RingBuffer // only if Window.Seconds > 0
+	Incremental       bool
+	Aggregates        map[string]*Aggregate // only if Incremental = true
+	mutex             sync.Mutex            // guards History, savedHistory, Breaches, Windows and Aggregates
 }
 
 type RiskDef struct {
+	Portfolio   *Portfolio
 	Path        string // python module path
 	Name        string
 	Groups      []interface{}
@@ -62,6 +77,18 @@ type RiskDef struct {
 	Filter      *Expression
 }
 
+// plain number of seconds or go duration, e.g. 3600, 90m, 72h
+func parseSeconds(str string) (float64, error) {
+	if v, err := strconv.ParseFloat(str, 64); err == nil {
+		return v, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	return d.Seconds(), nil
+}
+
 func split(s string, pattern string) []string {
 	res := strings.FieldsFunc(s, func(r rune) bool {
 		return strings.Index(pattern, string(r)) >= 0
@@ -76,10 +103,14 @@ func split(s string, pattern string) []string {
 func newRiskParamDef(s *IniSection, parent *RiskDef) (r *RiskParamDef, eres error) {
 	f := s.ValueMap["formula"]
 	r = &RiskParamDef{
-		Parent:     parent,
-		Name:       s.Name,
-		UpperBound: math.NaN(),
-		LowerBound: math.NaN(),
+		Parent:            parent,
+		Name:              s.Name,
+		UpperBound:        math.NaN(),
+		LowerBound:        math.NaN(),
+		Breaches:          make(map[string]*RiskAlert),
+		HistoryRetention:  24 * 3600,
+		HistoryResolution: 60,
+		HistoryTolerance:  1. / 2000,
 	}
 	var params map[string]interface{}
 	variables := s.SectionMap["var"]
@@ -112,6 +143,20 @@ func newRiskParamDef(s *IniSection, parent *RiskDef) (r *RiskParamDef, eres erro
 	if len(w) > 1 {
 		r.Window.Type = w[1]
 	}
+	if r.Window.Seconds > 0 {
+		if r.Window.Type == "" {
+			r.Window.Type = "change"
+		}
+		if funk.IndexOf(windowTypes, r.Window.Type) < 0 {
+			eres = fmt.Errorf("invalid window on line " + s.ValueMap["window"][1] + ": " + r.Window.Type + ": must be one of " + strings.Join(windowTypes, ", "))
+			return
+		}
+		if r.Formula == nil || r.Formula.A == "" || r.Formula.A == "top" || r.Formula.A == "call" {
+			eres = fmt.Errorf("invalid window on line " + s.ValueMap["window"][1] + ": only allowable for aggregate formula")
+			return
+		}
+		r.Windows = make(map[string]*RingBuffer)
+	}
 	str := s.ValueMap["upper_bound"][0]
 	if str != "" {
 		if v, err := strconv.ParseFloat(str, 64); err == nil {
@@ -124,6 +169,31 @@ func newRiskParamDef(s *IniSection, parent *RiskDef) (r *RiskParamDef, eres erro
 			r.LowerBound = v
 		}
 	}
+	for _, name := range []string{"history_retention", "history_resolution"} {
+		str = s.ValueMap[name][0]
+		if str == "" {
+			continue
+		}
+		v, err := parseSeconds(str)
+		if err != nil || v <= 0 {
+			eres = fmt.Errorf("invalid " + name + " on line " + s.ValueMap[name][1] + ": " + str)
+			return
+		}
+		if name == "history_retention" {
+			r.HistoryRetention = v
+		} else {
+			r.HistoryResolution = v
+		}
+	}
+	str = s.ValueMap["history_tolerance"][0]
+	if str != "" {
+		v, err := strconv.ParseFloat(str, 64)
+		if err != nil || v < 0 {
+			eres = fmt.Errorf("invalid history_tolerance on line " + s.ValueMap["history_tolerance"][1] + ": " + str)
+			return
+		}
+		r.HistoryTolerance = v
+	}
 	str = strings.ToLower(s.ValueMap["graph"][0])
 	if str == "true" || str == "y" || str == "yes" || str == "1" {
 		if r.Formula.A == "" {
@@ -131,7 +201,28 @@ func newRiskParamDef(s *IniSection, parent *RiskDef) (r *RiskParamDef, eres erro
 		} else {
 			r.Graph = true
 			r.History = make(map[string][][2]float64)
+			r.savedHistory = make(map[string]float64)
+		}
+	}
+	str = strings.ToLower(s.ValueMap["incremental"][0])
+	if str == "true" || str == "y" || str == "yes" || str == "1" {
+		if r.Formula == nil || funk.IndexOf(incrementalAggregates, r.Formula.A) < 0 {
+			eres = fmt.Errorf("invalid incremental on line " + s.ValueMap["incremental"][1] + ": only allowable for " + strings.Join(incrementalAggregates, ", ") + " formula")
+			return
+		}
+		for _, v := range r.Variables {
+			if v.E.A != "" {
+				eres = fmt.Errorf("invalid incremental on line " + s.ValueMap["incremental"][1] + ": not allowable with aggregate variable " + v.Name)
+				return
+			}
 		}
+		r.Incremental = true
+		r.Aggregates = make(map[string]*Aggregate)
+	}
+	if r.Formula != nil && r.Formula.A == "" {
+		// by default, only return top 10 result
+		r.Formula.A = "top"
+		r.Formula.N = 10
 	}
 	return
 }
@@ -149,20 +240,12 @@ func newRiskDef(s *IniSection, path string) (r *RiskDef, eres error) {
 	tmp := s.ValueMap["group"]
 	groups := split(tmp[0], ",")
 	for i, g := range groups {
-		ig := funk.IndexOf(predefinedGroupName, g)
-		if ig < 0 {
-			if g == "*" {
-				g = "true"
-			}
-			res, err := ParseExpr(tmp[1], g, "group", nil, true, path)
-			if err != nil {
-				eres = err
-				return
-			}
-			r.Groups = append(r.Groups, res)
-		} else {
-			r.Groups = append(r.Groups, ig)
+		res, err := parseGroup(tmp[1], g, path)
+		if err != nil {
+			eres = err
+			return
 		}
+		r.Groups = append(r.Groups, res)
 		if i >= len(r.GroupNames) {
 			r.GroupNames = append(r.GroupNames, g)
 		}
@@ -198,63 +281,230 @@ func newRiskDef(s *IniSection, path string) (r *RiskDef, eres error) {
 	return
 }
 
-func (self *RiskDef) Run(positions []*Position) interface{} {
-	grouped := make(map[string][]*Position)
-	if len(self.Groups) > 0 {
-		for i, expr := range self.Groups {
-			e, eok := expr.(*Expression)
+// string-valued group expression, e.g. Symbol or Currency+'/'+Market, the
+// value of which is the group name of each position
+type GroupKey struct {
+	E *Expression
+}
+
+// predefined group name index, *GroupKey, list of them for nested groups, or
+// boolean *Expression for a group named by group_name
+func parseGroup(ln string, g string, path string) (interface{}, error) {
+	if g == "*" {
+		g = "true"
+	}
+	if levels := parseHierarchy(ln, g, path); levels != nil {
+		return levels, nil
+	}
+	if ig := funk.IndexOf(predefinedGroupName, g); ig >= 0 {
+		return ig, nil
+	}
+	e, err := ParseExpr(ln, g, "group", nil, nil, path)
+	if err != nil {
+		return nil, err
+	}
+	if e.E == nil || e.A != "" {
+		return nil, fmt.Errorf("invalid group expression on line " + ln + ": " + g)
+	}
+	v, _ := Evaluate(e, &Position{Security: &Security{}})
+	switch v.(type) {
+	case string:
+		return &GroupKey{e}, nil
+	case bool:
+		return e, nil
+	}
+	return nil, fmt.Errorf("invalid group expression on line " + ln + ": " + g + ": which must return bool or string")
+}
+
+// e.g. acc>sector>industry, nil if g is not a list of predefined group names
+// or string-valued expressions, e.g. Pos>0
+func parseHierarchy(ln string, g string, path string) []interface{} {
+	if !strings.Contains(g, ">") {
+		return nil
+	}
+	var levels []interface{}
+	for _, name := range strings.Split(g, ">") {
+		name = strings.TrimSpace(name)
+		if ig := funk.IndexOf(predefinedGroupName, name); ig >= 0 {
+			levels = append(levels, ig)
+			continue
+		}
+		e, err := ParseExpr(ln, name, "group", nil, "", path)
+		if err != nil || e.E == nil || e.A != "" || len(e.E.Vars()) == 0 {
+			return nil
+		}
+		levels = append(levels, &GroupKey{e})
+	}
+	return levels
+}
+
+func groupKey(group interface{}, p *Position) string {
+	switch group {
+	case GROUP_SECTOR:
+		return p.Security.Sector
+	case GROUP_INDUSTRY:
+		return p.Security.Industry
+	case GROUP_SUBINDUSTRY:
+		return p.Security.SubIndustry
+	case GROUP_MARKET:
+		return p.Security.Market
+	case GROUP_TYPE:
+		return p.Security.Type
+	case GROUP_CURRENCY:
+		return p.Security.Currency
+	case GROUP_ACC:
+		return p.AccName
+	case GROUP_UNDERLYING:
+		return p.Security.UnderlyingSymbol()
+	}
+	if k, ok := group.(*GroupKey); ok {
+		v, _ := Evaluate(k.E, p)
+		tmp, _ := v.(string)
+		return tmp
+	}
+	return ""
+}
+
+// positions of one group spec by group name, nested groups are keyed by their
+// path, e.g. "acc1>Technology", and listed under their parent path in Tree, top
+// level ones under ""
+type Grouping struct {
+	Positions map[string][]*Position
+	Tree      map[string][]string // nil unless nested
+}
+
+// one Grouping per group spec, kept apart so that e.g. group=acc,acc>sector does
+// not add the positions of acc1 twice to the same group
+func (self *RiskDef) group(positions []*Position) []*Grouping {
+	if self.Filter != nil {
+		var filtered []*Position
+		for _, p := range positions {
+			v, _ := Evaluate(self.Filter, p)
+			if v2, ok2 := v.(bool); ok2 && !v2 {
+				continue
+			}
+			filtered = append(filtered, p)
+		}
+		positions = filtered
+	}
+	if len(self.Groups) == 0 {
+		return []*Grouping{{Positions: map[string][]*Position{"": positions}}}
+	}
+	out := make([]*Grouping, 0, len(self.Groups))
+	for i, expr := range self.Groups {
+		g := &Grouping{Positions: make(map[string][]*Position)}
+		out = append(out, g)
+		if levels, ok := expr.([]interface{}); ok {
+			g.Tree = make(map[string][]string)
 			for _, p := range positions {
-				if self.Filter != nil {
-					v, _ := Evaluate(self.Filter, p)
-					if v2, ok2 := v.(bool); ok2 {
-						if !v2 {
-							continue
-						}
+				path := ""
+				for _, level := range levels {
+					key := groupKey(level, p)
+					if key == "" {
+						break
 					}
-				}
-				tmp := ""
-				if eok {
-					v, _ := Evaluate(e, p)
-					if v2, ok2 := v.(bool); ok2 {
-						if v2 {
-							tmp = self.GroupNames[i]
-						}
+					parent := path
+					if path != "" {
+						path += ">"
 					}
-				} else {
-					switch expr {
-					case GROUP_SECTOR:
-						tmp = p.Security.Sector
-					case GROUP_INDUSTRY:
-						tmp = p.Security.Industry
-					case GROUP_SUBINDUSTRY:
-						tmp = p.Security.SubIndustry
-					case GROUP_MARKET:
-						tmp = p.Security.Market
-					case GROUP_TYPE:
-						tmp = p.Security.Type
-					case GROUP_CURRENCY:
-						tmp = p.Security.Currency
-					case GROUP_ACC:
-						tmp = AccNames[p.Acc]
+					path += key
+					if _, ok := g.Positions[path]; !ok {
+						g.Tree[parent] = append(g.Tree[parent], path)
 					}
+					g.Positions[path] = append(g.Positions[path], p)
 				}
-				if tmp != "" {
-					grouped[tmp] = append(grouped[tmp], p)
+			}
+			continue
+		}
+		e, eok := expr.(*Expression)
+		for _, p := range positions {
+			tmp := ""
+			if eok {
+				v, _ := Evaluate(e, p)
+				if v2, ok2 := v.(bool); ok2 && v2 {
+					tmp = self.GroupNames[i]
 				}
+			} else {
+				tmp = groupKey(expr, p)
 			}
-			if len(self.GroupNames) > i {
-				expr = self.GroupNames[i]
+			if tmp != "" {
+				g.Positions[tmp] = append(g.Positions[tmp], p)
 			}
 		}
-	} else {
-		grouped[""] = positions
 	}
+	return out
+}
+
+// key of the window, breach, history and aggregate state of group gname of the
+// i-th group spec, since two specs may give groups of the same name
+func groupStateKey(i int, gname string) string {
+	return strconv.Itoa(i) + "|" + gname
+}
+
+// group name of a state key
+func groupOfKey(key string) string {
+	return key[strings.Index(key, "|")+1:]
+}
+
+// [name, value, children] for each child of parent, children omitted for leaves
+func subtotals(tree map[string][]string, values map[string]interface{}, parent string) []interface{} {
+	var out []interface{}
+	for _, path := range tree[parent] {
+		name := path[strings.LastIndex(path, ">")+1:]
+		if children := subtotals(tree, values, path); len(children) > 0 {
+			out = append(out, []interface{}{name, values[path], children})
+		} else {
+			out = append(out, []interface{}{name, values[path]})
+		}
+	}
+	return out
+}
+
+func (self *RiskDef) Run(positions []*Position) interface{} {
+	return self.run(positions, (*RiskParamDef).Run)
+}
+
+// plain values of positions shocked by a scenario, without windows, bounds or history
+func (self *RiskDef) RunScenario(positions []*Position) interface{} {
+	return self.run(positions, func(rp *RiskParamDef, _ string, positions []*Position) interface{} {
+		return rp.value(positions)
+	})
+}
+
+// values as Run would give them, without pushing to windows, checking bounds or
+// recording history, for read-only requests
+func (self *RiskDef) Peek(positions []*Position) interface{} {
+	now := float64(time.Now().Unix())
+	return self.run(positions, func(rp *RiskParamDef, key string, positions []*Position) interface{} {
+		v := rp.value(positions)
+		if v2, ok := v.(float64); ok && rp.Window.Seconds > 0 {
+			if v2 = rp.peekWindow(key, now, v2); math.IsNaN(v2) {
+				return "NaN"
+			}
+			return v2
+		}
+		return v
+	})
+}
+
+// value is given the state key of each group, see groupStateKey
+func (self *RiskDef) run(positions []*Position, value func(*RiskParamDef, string, []*Position) interface{}) interface{} {
+	groupings := self.group(positions)
 	rpt := make(map[string]interface{})
 	for _, rp := range self.Params {
 		var out []interface{}
-		for gname, positions := range grouped {
-			if len(positions) > 0 {
-				out = append(out, []interface{}{gname, rp.Run(gname, positions)})
+		for i, g := range groupings {
+			values := make(map[string]interface{})
+			for gname, positions := range g.Positions {
+				if len(positions) > 0 {
+					values[gname] = value(rp, groupStateKey(i, gname), positions)
+					if g.Tree == nil {
+						out = append(out, []interface{}{gname, values[gname]})
+					}
+				}
+			}
+			if g.Tree != nil {
+				out = append(out, subtotals(g.Tree, values, "")...)
 			}
 		}
 		if len(out) > 0 {
@@ -304,37 +554,47 @@ func std(nums []float64) float64 {
 	return sd
 }
 
+func (self *RiskParamDef) evaluatePos(e *Expression, p *Position, params map[string]interface{}, isFormula bool) float64 {
+	if isFormula {
+		// prepare non-aggregate variable
+		for _, v := range self.Variables {
+			if v.E.A == "" {
+				params[v.Name], _ = Evaluate(v.E, p, params)
+			}
+		}
+	}
+	tmp, err := Evaluate(e, p, params)
+	if v, ok := tmp.(float64); ok && err == nil {
+		return v
+	}
+	return math.NaN()
+}
+
 func (self *RiskParamDef) evaluate(positions []*Position, params map[string]interface{}, optional ...*Expression) interface{} {
-	var e *Expression
-	var isFormula bool
 	if len(optional) > 0 {
-		e = optional[0]
-	} else {
-		e = self.Formula
-		isFormula = true
-		if e.A == "" {
-			// by default, only return top 10 result
-			e.A = "top"
-			e.N = 10
-		}
+		return self.evaluateExpr(optional[0], positions, params, false)
+	}
+	return self.evaluateExpr(self.Formula, positions, params, true)
+}
+
+func (self *RiskParamDef) evaluateExpr(e *Expression, positions []*Position, params map[string]interface{}, isFormula bool) interface{} {
+	if e.A == "scenario" {
+		return self.scenarioValue(e, positions, params, isFormula)
 	}
 	if e.A == "call" {
 		res, _ := CallPy(e.C[0], e.C[1], e.C[2], positions, self.Parent.Path)
 		return res
 	}
+	if e.A == "var" || e.A == "es" {
+		if value := historicalRisk(e, positions); !math.IsNaN(value) {
+			return value
+		}
+		return "NaN"
+	}
 	value := math.NaN()
 	res := make([]float64, 0, len(positions))
 	for _, p := range positions {
-		if isFormula {
-			// prepare non-aggregate variable
-			for _, v := range self.Variables {
-				if v.E.A == "" {
-					params[v.Name], _ = Evaluate(v.E, p, params)
-				}
-			}
-		}
-		tmp, _ := Evaluate(e, p, params)
-		res = append(res, tmp.(float64))
+		res = append(res, self.evaluatePos(e, p, params, isFormula))
 	}
 	if e.A == "std" {
 		value = std(res)
@@ -345,7 +605,7 @@ func (self *RiskParamDef) evaluate(positions []*Position, params map[string]inte
 	} else if e.A == "mean" {
 		value = mean(res)
 	} else if e.A == "top" {
-		tmp := make([][2]interface{}, 0, len(Positions))
+		tmp := make([][2]interface{}, 0, len(positions))
 		for i, p := range positions {
 			if math.IsNaN(res[i]) {
 				continue
@@ -373,7 +633,7 @@ func (self *RiskParamDef) evaluate(positions []*Position, params map[string]inte
 	return value
 }
 
-func (self *RiskParamDef) Run(gname string, positions []*Position) interface{} {
+func (self *RiskParamDef) value(positions []*Position) interface{} {
 	var params map[string]interface{}
 	// prepare aggregate variable
 	if len(self.Variables) > 0 {
@@ -384,32 +644,59 @@ func (self *RiskParamDef) Run(gname string, positions []*Position) interface{} {
 			}
 		}
 	}
-	v := self.evaluate(positions, params)
+	return self.evaluate(positions, params)
+}
+
+// key is the state key of the group, see groupStateKey
+func (self *RiskParamDef) Run(key string, positions []*Position) interface{} {
+	var v interface{}
+	if self.Incremental {
+		self.mutex.Lock()
+		v = self.incrementalValue(key, positions)
+		self.mutex.Unlock()
+	} else {
+		v = self.value(positions)
+	}
+	now := float64(time.Now().Unix())
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if v2, ok2 := v.(float64); ok2 {
+		if self.Window.Seconds > 0 {
+			v2 = self.applyWindow(key, now, v2)
+			if math.IsNaN(v2) {
+				v = "NaN"
+			} else {
+				v = v2
+			}
+		}
+		self.checkBounds(key, v2)
+	}
 	if self.Graph {
 		if v2, ok2 := v.(float64); ok2 {
-			tmp := self.History[gname]
+			tmp := self.History[key]
 			n := len(tmp)
-			now := float64(time.Now().Unix())
-			if n > 1 && now-tmp[0][0] > 25*3600 { // reduce history every 1h
+			retention := self.HistoryRetention
+			if n > 1 && now-tmp[0][0] > retention*25/24 { // reduce history every 1/24 of retention
 				for i := 1; i < n; i += 1 {
-					if now-tmp[i][0] < 24*3600 {
+					if now-tmp[i][0] < retention {
 						tmp = tmp[i:]
 						n = len(tmp)
+						self.History[key] = tmp
 						break
 					}
 				}
 			}
 			if n > 1 {
 				tmp1 := tmp[n-2]
-				tmp2 := tmp[n-1]
-				if now-tmp1[0] > 60. && math.Abs(tmp1[1]-v2) > math.Abs(tmp1[1]+v2)/2000. {
-					self.History[gname] = append(tmp, [2]float64{now, v2})
+				tmp2 := &tmp[n-1]
+				if now-tmp1[0] > self.HistoryResolution && math.Abs(tmp1[1]-v2) > math.Abs(tmp1[1]+v2)*self.HistoryTolerance {
+					self.History[key] = append(tmp, [2]float64{now, v2})
 				} else {
 					tmp2[0] = now
 					tmp2[1] = v2
 				}
 			} else {
-				self.History[gname] = append(tmp, [2]float64{now, v2})
+				self.History[key] = append(tmp, [2]float64{now, v2})
 			}
 		}
 	}
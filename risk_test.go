@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Tech is an industry of one position and the sector of another, and the top
+// level of a nested group as well, each spec keeps its own state
+func TestOverlappingGroupSpecs(t *testing.T) {
+	cfg, err := ParseIni(`
+[gross]
+group=industry, sector, sector>industry
+formula=sum(Pos*Close)
+incremental=Y
+window=60,max
+upper_bound=500
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio, err := ParsePortfolio(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := func(id int64, sector string, industry string, qty float64) *Position {
+		s := &Security{Id: id, Sector: sector, Industry: industry, Multiplier: 1, Rate: 1}
+		s.Close = 10
+		p := &Position{Acc: 1, Security: s}
+		p.Qty = qty
+		p.seq = 1
+		p.changedSeq = 1
+		return p
+	}
+	positions := []*Position{pos(1, "Tech", "Software", 100), pos(2, "Energy", "Tech", 10)}
+	riskDef := portfolio.RiskDefs[0]
+	pendingAlerts = nil
+	var got interface{}
+	for i := 0; i < 2; i++ {
+		got = riskDef.Run(positions)
+	}
+	var flat, nested []string
+	for _, item := range got.([]interface{}) {
+		tmp := item.([]interface{})
+		if len(tmp) == 3 {
+			nested = append(nested, fmt.Sprintf("%v %v", tmp[0], tmp[1]))
+		} else {
+			flat = append(flat, fmt.Sprintf("%v %v", tmp[0], tmp[1]))
+		}
+	}
+	sort.Strings(flat)
+	sort.Strings(nested)
+	if want := []string{"Energy 100", "Software 1000", "Tech 100", "Tech 1000"}; !reflect.DeepEqual(flat, want) {
+		t.Errorf("flat groups %v, want %v", flat, want)
+	}
+	if want := []string{"Energy 100", "Tech 1000"}; !reflect.DeepEqual(nested, want) {
+		t.Errorf("nested groups %v, want %v", nested, want)
+	}
+	rp := riskDef.Params[0]
+	var keys []string
+	for key := range rp.Breaches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"0|Software", "1|Tech", "2|Tech", "2|Tech>Software"}) {
+		t.Errorf("breaches %v", keys)
+	}
+	// breached once each, no recover and re-breach on the second run
+	if len(pendingAlerts) != 4 {
+		t.Errorf("%d alerts, want 4", len(pendingAlerts))
+	}
+	for _, alert := range pendingAlerts {
+		if alert.Status != "breach" || (alert.Group != "Tech" && alert.Group != "Software" && alert.Group != "Tech>Software") {
+			t.Errorf("alert %+v", alert)
+		}
+	}
+	if len(rp.Windows) != 8 || len(rp.Aggregates) != 8 {
+		t.Errorf("%d windows and %d aggregates, want 8", len(rp.Windows), len(rp.Aggregates))
+	}
+	pendingAlerts = nil
+}
+
+func TestExpressionGroups(t *testing.T) {
+	cfg, err := ParseIni(`
+[gross]
+group=Currency+'/'+Market, Pos>0
+formula=sum(Pos*Close)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio, err := ParsePortfolio(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := func(id int64, currency string, market string, qty float64) *Position {
+		s := &Security{Id: id, Currency: currency, Market: market, Multiplier: 1, Rate: 1}
+		s.Close = 10
+		p := &Position{Acc: 1, Security: s}
+		p.Qty = qty
+		return p
+	}
+	positions := []*Position{pos(1, "HKD", "HK", 10), pos(2, "HKD", "HK", -5), pos(3, "USD", "US", 20)}
+	var got []string
+	for _, item := range portfolio.RiskDefs[0].Run(positions).([]interface{}) {
+		tmp := item.([]interface{})
+		got = append(got, fmt.Sprintf("%v %v", tmp[0], tmp[1]))
+	}
+	sort.Strings(got)
+	if want := []string{"HKD/HK 50", "Pos>0 300", "USD/US 200"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("groups %v, want %v", got, want)
+	}
+	for _, g := range []string{"Pos*Close", "sum(Pos)"} {
+		cfg, _ := ParseIni("[gross]\ngroup=" + g + "\nformula=sum(Pos*Close)\n")
+		if _, err := ParsePortfolio(cfg, ""); err == nil {
+			t.Errorf("group=%s accepted", g)
+		}
+	}
+}
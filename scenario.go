@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var scenariosFile = flag.String("scenarios", "scenarios.ini", "stress scenarios, reloaded on change")
+
+// relative price shock of the securities matching Filter, or fx shock of
+// Currency against all other currencies, e.g. -0.1 for -10%. Shocks matching
+// the same security or currency compound, e.g. -10% and -15% give -23.5%.
+type Shock struct {
+	Filter   *Expression
+	Currency string
+	Change   float64
+}
+
+// e.g.
+// [HK -10%]
+// price=Market=='HK': -10%
+// [CNY +3%]
+// fx=CNY: +3%
+// [HK down with Tech]
+// price=Market=='HK': -10%; Sector=='Information Technology': -15%
+// fx=HKD: -1%
+type Scenario struct {
+	Name   string
+	Shocks []Shock
+}
+
+type Scenarios struct {
+	List   []*Scenario
+	ByName map[string]*Scenario
+}
+
+var scenarios atomic.Value // *Scenarios
+
+func getScenarios() *Scenarios {
+	tmp, _ := scenarios.Load().(*Scenarios)
+	if tmp == nil {
+		return &Scenarios{}
+	}
+	return tmp
+}
+
+// -10%, +3% or -0.1
+func parseChange(str string) (float64, error) {
+	str = strings.TrimSpace(str)
+	if strings.HasSuffix(str, "%") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(str[:len(str)-1]), 64)
+		return v / 100, err
+	}
+	return strconv.ParseFloat(str, 64)
+}
+
+func parseScenario(s *IniSection) (*Scenario, error) {
+	sc := &Scenario{Name: s.Name}
+	for _, nameValue := range s.Values {
+		kind, ln := nameValue[0], nameValue[2]
+		if kind != "price" && kind != "fx" {
+			return nil, fmt.Errorf("invalid shock on line " + ln + ": " + kind + ": must be price or fx")
+		}
+		for _, str := range split(nameValue[1], ";") {
+			if str == "" {
+				continue
+			}
+			i := strings.LastIndex(str, ":")
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid shock on line " + ln + ": " + str + ": must be <target>: <change>")
+			}
+			change, err := parseChange(str[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid shock on line " + ln + ": " + str + ": " + err.Error())
+			}
+			target := strings.TrimSpace(str[:i])
+			shock := Shock{Change: change}
+			if kind == "fx" {
+				shock.Currency = target
+			} else {
+				e, err := ParseExpr(ln, target, "price shock", nil, true, "")
+				if err != nil {
+					return nil, err
+				}
+				shock.Filter = e
+			}
+			sc.Shocks = append(sc.Shocks, shock)
+		}
+	}
+	return sc, nil
+}
+
+func LoadScenarios(fn string) (*Scenarios, error) {
+	out := &Scenarios{ByName: make(map[string]*Scenario)}
+	cfg, err := ParseIniFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return nil, err
+	}
+	for _, s := range cfg.Sections {
+		sc, err := parseScenario(s)
+		if err != nil {
+			return nil, err
+		}
+		out.List = append(out.List, sc)
+		out.ByName[sc.Name] = sc
+	}
+	log.Println(len(out.List), "scenarios loaded from", fn)
+	return out, nil
+}
+
+func reloadScenarios() bool {
+	sc, err := LoadScenarios(*scenariosFile)
+	if err != nil {
+		log.Println("failed to load", *scenariosFile+":", err)
+		return true
+	}
+	scenarios.Store(sc)
+	missingScenarios.Range(func(k, _ interface{}) bool {
+		missingScenarios.Delete(k)
+		return true
+	})
+	return true
+}
+
+// compounded fx shocks of ccy, 1 if none
+func (sc *Scenario) fxChange(ccy string) float64 {
+	change := 1.
+	for _, shock := range sc.Shocks {
+		if shock.Filter == nil && shock.Currency == ccy {
+			change *= 1 + shock.Change
+		}
+	}
+	return change
+}
+
+// copy of pairs with the fx shocks applied, nil if none
+func (sc *Scenario) shockFxPairs(pairs map[string]float64) map[string]float64 {
+	hasFx := false
+	for _, shock := range sc.Shocks {
+		hasFx = hasFx || shock.Filter == nil
+	}
+	if !hasFx {
+		return nil
+	}
+	out := make(map[string]float64, len(pairs))
+	for pair, v := range pairs {
+		out[pair] = v * sc.fxChange(pair[:3]) / sc.fxChange(pair[3:])
+	}
+	return out
+}
+
+// shocked copy of s and its underlying, price filters are evaluated on the
+// security only, Rate converts into currency
+func (sc *Scenario) shock(s *Security, currency string, pairs map[string]float64, securities map[*Security]*Security) *Security {
+	if s2 := securities[s]; s2 != nil {
+		return s2
+	}
+	s2 := *s
+	securities[s] = &s2
+	close := s.GetClose()
+	for _, shock := range sc.Shocks {
+		if shock.Filter != nil {
+			v, _ := Evaluate(shock.Filter, &Position{Security: s})
+			if v2, ok := v.(bool); ok && v2 {
+				close *= 1 + shock.Change
+			}
+		}
+	}
+	s2.Close = close
+	if pairs != nil {
+		s2.Rate *= sc.fxChange(s.Currency) / sc.fxChange(currency)
+		s2.fxPairs = pairs
+	}
+	if s.underlying != nil {
+		s2.underlying = sc.shock(s.underlying, currency, pairs, securities)
+	}
+	return &s2
+}
+
+// copies of positions with shocked prices, rates and fx rates, for Rate
+// converting into currency, securities of the copies are copied as well and
+// shared among them
+func (sc *Scenario) Apply(positions []*Position, currency string) []*Position {
+	out := make([]*Position, 0, len(positions))
+	if len(positions) == 0 {
+		return out
+	}
+	pairs := sc.shockFxPairs(positions[0].Security.getFxPairs())
+	securities := make(map[*Security]*Security)
+	for _, p := range positions {
+		p2 := *p
+		p2.Security = sc.shock(p.Security, currency, pairs, securities)
+		out = append(out, &p2)
+	}
+	return out
+}
+
+// names of scenarios found missing by scenarioValue, logged once until reload
+var missingScenarios sync.Map
+
+// for A == "scenario", NaN if the scenario no longer exists
+func (self *RiskParamDef) scenarioValue(e *Expression, positions []*Position, params map[string]interface{}, isFormula bool) interface{} {
+	sc := getScenarios().ByName[e.S]
+	if sc == nil {
+		if _, ok := missingScenarios.LoadOrStore(e.S, true); !ok {
+			log.Printf("scenario %s of %s/%s not found in %s", e.S, self.Parent.DisplayName, self.Name, *scenariosFile)
+		}
+		return "NaN"
+	}
+	return self.evaluateExpr(e.X, sc.Apply(positions, self.Parent.Portfolio.rateCurrency()), params, isFormula)
+}
+
+// currency Rate converts into for p, empty if that of the security message
+func (p *Portfolio) rateCurrency() string {
+	if p != nil && p.Currency != "" {
+		return p.Currency
+	}
+	return *reportingCurrency
+}
+
+// scenarios listed by the portfolio's scenarios= key, * for all
+func (p *Portfolio) scenarios() []*Scenario {
+	if len(p.ScenarioNames) == 0 {
+		return nil
+	}
+	all := getScenarios()
+	if p.ScenarioNames[0] == "*" {
+		return all.List
+	}
+	var out []*Scenario
+	for _, name := range p.ScenarioNames {
+		if sc := all.ByName[name]; sc != nil {
+			out = append(out, sc)
+		}
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitScenarioArgs(t *testing.T) {
+	tests := []struct {
+		args      string
+		name      string
+		aggregate string
+		ok        bool
+	}{
+		{"HK -10%, sum(Pos*Close)", "HK -10%", "sum(Pos*Close)", true},
+		{"HK, CN -10%, sum(Pos*Close)", "HK, CN -10%", "sum(Pos*Close)", true},
+		{"'HK, CN -10%', sum(Pos*Close)", "HK, CN -10%", "sum(Pos*Close)", true},
+		{"HK -10%, sum(Market == 'A,B' ? Pos : 0)", "HK -10%", "sum(Market == 'A,B' ? Pos : 0)", true},
+		{"sum(Pos*Close)", "", "", false},
+		{", sum(Pos*Close)", "", "sum(Pos*Close)", false},
+	}
+	for _, tt := range tests {
+		name, aggregate, ok := splitScenarioArgs(tt.args)
+		if name != tt.name || aggregate != tt.aggregate || ok != tt.ok {
+			t.Errorf("splitScenarioArgs(%q) = %q, %q, %v, want %q, %q, %v", tt.args, name, aggregate, ok, tt.name, tt.aggregate, tt.ok)
+		}
+	}
+}
+
+func TestScenarioApply(t *testing.T) {
+	cfg, err := ParseIni(`
+[HK down with Tech]
+price=Market=='HK': -10%; Sector=='Tech': -15%
+fx=HKD: +10%; HKD: -10%; EUR: +25%
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := parseScenario(cfg.Sections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := map[string]float64{"USDHKD": 8, "EURUSD": 1.2, "EURHKD": 9.6}
+	want := map[string]float64{"USDHKD": 8 / 0.99, "EURUSD": 1.2 * 1.25, "EURHKD": 9.6 * 1.25 / 0.99}
+	got := sc.shockFxPairs(pairs)
+	for pair, v := range want {
+		if !floatEqual(got[pair], v) {
+			t.Errorf("%s shocked to %v, want %v", pair, got[pair], v)
+		}
+	}
+	if !reflect.DeepEqual(pairs, map[string]float64{"USDHKD": 8, "EURUSD": 1.2, "EURHKD": 9.6}) {
+		t.Errorf("pairs modified: %v", pairs)
+	}
+	pos := func(market string, sector string, currency string) *Position {
+		s := &Security{Market: market, Sector: sector, Currency: currency, Rate: 2, fxPairs: pairs}
+		s.Close = 100
+		return &Position{Security: s}
+	}
+	positions := []*Position{pos("HK", "Tech", "HKD"), pos("HK", "Energy", "HKD"), pos("US", "Tech", "EUR"), pos("US", "Energy", "USD")}
+	tests := []struct {
+		close, rate float64
+	}{
+		{100 * 0.9 * 0.85, 2 * 0.99 / 1.25},
+		{100 * 0.9, 2 * 0.99 / 1.25},
+		{100 * 0.85, 2},
+		{100, 2 / 1.25},
+	}
+	out := sc.Apply(positions, "EUR")
+	for i, tt := range tests {
+		s := out[i].Security
+		if !floatEqual(s.Close, tt.close) || !floatEqual(s.Rate, tt.rate) {
+			t.Errorf("position %d: close %v rate %v, want %v %v", i, s.Close, s.Rate, tt.close, tt.rate)
+		}
+		if positions[i].Security.Close != 100 || positions[i].Security.Rate != 2 {
+			t.Errorf("position %d: security modified", i)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+var snapshotFile = flag.String("snapshot", "snapshot.gob", "file to save positions and orders to, empty to disable")
+var snapshotInterval = flag.Duration("snapshot_interval", time.Minute, "interval of saving snapshot, 0 to disable")
+
+// securities are saved once, positions and orders refer to them by id only
+type Snapshot struct {
+	Date       string
+	SeqNum     int64
+	Securities []*Security
+	Positions  []*Position
+	Orders     []*Order
+}
+
+func securityRef(s *Security) *Security {
+	return &Security{Id: s.Id}
+}
+
+func EncodeSnapshot() []byte {
+	snapshot := Snapshot{
+		Date:   time.Now().Format("20060102"),
+		SeqNum: seqNum,
+	}
+	for _, s := range SecurityMapById {
+		snapshot.Securities = append(snapshot.Securities, s)
+	}
+	for _, tmp := range Positions {
+		for _, p := range tmp {
+			p2 := *p
+			p2.Security = securityRef(p.Security)
+			snapshot.Positions = append(snapshot.Positions, &p2)
+		}
+	}
+	for _, ord := range orders {
+		ord2 := *ord
+		ord2.Security = securityRef(ord.Security)
+		snapshot.Orders = append(snapshot.Orders, &ord2)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&snapshot); err != nil {
+		log.Println("failed to encode snapshot:", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// must be called on the goroutine owning the order book, writing to disk is done in background
+func SaveSnapshot() {
+	if *snapshotFile == "" || !offlineDone {
+		return
+	}
+	data := EncodeSnapshot()
+	if data == nil {
+		return
+	}
+	go func() {
+		tmp := *snapshotFile + ".tmp"
+		if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+			log.Println("failed to write snapshot:", err)
+			return
+		}
+		if err := os.Rename(tmp, *snapshotFile); err != nil {
+			log.Println("failed to write snapshot:", err)
+		}
+	}()
+}
+
+// load today's snapshot if any, so that only messages after its seqNum are requested from trade server
+func RestoreSnapshot() {
+	if *snapshotFile == "" {
+		return
+	}
+	f, err := os.Open(*snapshotFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var snapshot Snapshot
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		log.Println("failed to decode snapshot:", err)
+		return
+	}
+	if snapshot.Date != time.Now().Format("20060102") {
+		log.Println("ignore snapshot of", snapshot.Date)
+		return
+	}
+	for _, s := range snapshot.Securities {
+		// snapshots of older versions
+		if s.MsgRate <= 0 {
+			s.MsgRate = s.Rate
+		}
+		SecurityMapById[s.Id] = s
+		indexCurrency(s)
+		tmp := SecurityMapByMarket[s.Market]
+		if tmp == nil {
+			tmp = make(map[string]*Security)
+			SecurityMapByMarket[s.Market] = tmp
+		}
+		tmp[s.Symbol] = s
+	}
+	for _, p := range snapshot.Positions {
+		p.Security = SecurityMapById[p.Security.Id]
+		if p.Security == nil {
+			continue
+		}
+		tmp := Positions[p.Acc]
+		if tmp == nil {
+			tmp = make(map[int64]*Position)
+			Positions[p.Acc] = tmp
+		}
+		tmp[p.Security.Id] = p
+		usedSecurities[p.Security.Id] = true
+		// -lot_method changed since the snapshot was saved
+		if p.LotMethod != "" && p.LotMethod != lotMethod(p.AccName) {
+			p.rebuild()
+		}
+	}
+	for _, ord := range snapshot.Orders {
+		ord.Security = SecurityMapById[ord.Security.Id]
+		if ord.Security == nil {
+			continue
+		}
+		orders[ord.Id] = ord
+	}
+	seqNum = snapshot.SeqNum
+	bodDone = true
+	log.Printf("restored snapshot: %d securities, %d positions, %d orders, seqNum %d", len(snapshot.Securities), len(snapshot.Positions), len(snapshot.Orders), seqNum)
+}
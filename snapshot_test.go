@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+// positions restored are rebuilt if -lot_method changed across the restart
+func TestRestoreSnapshotLotMethod(t *testing.T) {
+	if err := ParseLotMethods("fifo"); err != nil {
+		t.Fatal(err)
+	}
+	defer ParseLotMethods(*lotMethodFlag)
+	saved := *snapshotFile
+	*snapshotFile = path.Join(t.TempDir(), "snapshot.gob")
+	defer func() { *snapshotFile = saved }()
+	defer func() {
+		Positions = make(map[int]map[int64]*Position)
+		orders = make(map[int64]*Order)
+		SecurityMapById = make(map[int64]*Security)
+		delete(SecurityMapByMarket, "TEST")
+		delete(securitiesByCurrency[""], 1)
+		seqNum = 0
+		bodDone = false
+	}()
+
+	s := &Security{Id: 1, Symbol: "SNAPTEST", Market: "TEST", Multiplier: 1, Rate: 1}
+	SecurityMapById[s.Id] = s
+	p := &Position{Acc: 1, AccName: "A1", Security: s}
+	Positions[1] = map[int64]*Position{s.Id: p}
+	for i, f := range [][2]float64{{100, 10}, {100, 12}, {-150, 15}} {
+		ord := &Order{Id: int64(i + 1), St: "filled", Type: "otc", Security: s, Side: "buy", LastQty: f[0], LastPx: f[1]}
+		if f[0] < 0 {
+			ord.Side = "sell"
+			ord.LastQty = -f[0]
+		}
+		p.update(ord)
+	}
+	if p.RealizedPnl != 650 || p.LotMethod != "fifo" {
+		t.Fatalf("fifo: realized %v method %s, want 650, fifo", p.RealizedPnl, p.LotMethod)
+	}
+	if err := ioutil.WriteFile(*snapshotFile, EncodeSnapshot(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	Positions = make(map[int]map[int64]*Position)
+	SecurityMapById = make(map[int64]*Security)
+	if err := ParseLotMethods("lifo"); err != nil {
+		t.Fatal(err)
+	}
+	RestoreSnapshot()
+	p = Positions[1][1]
+	if p == nil {
+		t.Fatal("position not restored")
+	}
+	if p.Qty != 50 || p.AvgPx != 10 || p.RealizedPnl != 550 || p.LotMethod != "lifo" {
+		t.Errorf("lifo: qty %v avg px %v realized %v method %s, want 50, 10, 550, lifo", p.Qty, p.AvgPx, p.RealizedPnl, p.LotMethod)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+// State is what risk evaluation reads. The order book, account and portfolio
+// globals are only touched by the goroutine running tradeServerJob, which
+// takes a copy of them for every evaluation so that it can run on another
+// goroutine while market data and orders keep coming in.
+type State struct {
+	Positions      map[int]map[int64]*Position
+	AccNames       map[int]string
+	UserIdAccs     map[int][]int
+	UserPortfolios map[int]map[string]*Portfolio
+	Subscriptions  map[int]Subscriptions // see collectSubscriptions
+	// changes since last evaluation, whose reports are kept in Previous for portfolios not affected
+	AllDirty        bool
+	DirtyAccs       map[int]bool
+	DirtySecurities map[int64]bool
+	DirtyWindows    bool
+	DirtyFx         bool
+	Previous        map[int]map[string]interface{}
+	FxPairs         map[string]float64 // see fxSnapshot
+}
+
+// the globals as they are, only for use on the tradeServerJob goroutine
+func liveState() *State {
+	linkUnderlyings()
+	return &State{
+		Positions:      Positions,
+		AccNames:       AccNames,
+		UserIdAccs:     UserIdAccs,
+		UserPortfolios: UserPortfolios,
+		Subscriptions:  collectSubscriptions(),
+		FxPairs:        getFxPairs(),
+	}
+}
+
+// copy for the next scheduled evaluation, handing over the changes since the last one
+func TakeState() *State {
+	state := copyState(func(p *Position) bool {
+		return allDirty || dirtyAccs[p.Acc] || isSecurityDirty(p.Security, dirtySecurities)
+	}, true)
+	state.AllDirty = allDirty
+	state.DirtyAccs = dirtyAccs
+	state.DirtySecurities = dirtySecurities
+	state.DirtyWindows = dirtyWindows
+	state.DirtyFx = dirtyFx
+	state.Previous = lastReports
+	allDirty = false
+	dirtyAccs = make(map[int]bool)
+	dirtySecurities = make(map[int64]bool)
+	dirtyWindows = false
+	dirtyFx = false
+	return state
+}
+
+// copy for an evaluation out of schedule, everything is considered changed
+func CopyState() *State {
+	state := copyState(func(*Position) bool { return true }, false)
+	state.AllDirty = true
+	return state
+}
+
+var stateSeq int64 = 0
+
+// deep copy of positions and their securities, portfolios are shared and
+// guard their own mutable state. Positions changed are stamped with the seq
+// of the copy, and so are the live ones if record, so that evaluations which
+// skip some copies still see every change since the copy they last ran on.
+func copyState(changed func(*Position) bool, record bool) *State {
+	linkUnderlyings()
+	stateSeq++
+	state := &State{
+		Positions:      make(map[int]map[int64]*Position, len(Positions)),
+		AccNames:       make(map[int]string, len(AccNames)),
+		UserIdAccs:     make(map[int][]int, len(UserIdAccs)),
+		UserPortfolios: make(map[int]map[string]*Portfolio, len(UserPortfolios)),
+		Subscriptions:  collectSubscriptions(),
+		FxPairs:        getFxPairs(),
+	}
+	securities := make(map[int64]*Security)
+	var copySecurity func(s *Security) *Security
+	copySecurity = func(s *Security) *Security {
+		if s2 := securities[s.Id]; s2 != nil {
+			return s2
+		}
+		s2 := *s
+		s2.fxPairs = state.FxPairs
+		securities[s.Id] = &s2
+		if s.underlying != nil {
+			s2.underlying = copySecurity(s.underlying)
+		}
+		return &s2
+	}
+	for acc, tmp := range Positions {
+		tmp2 := make(map[int64]*Position, len(tmp))
+		for securityId, p := range tmp {
+			p2 := *p
+			p2.Security = copySecurity(p.Security)
+			p2.seq = stateSeq
+			if changed(p) {
+				p2.changedSeq = stateSeq
+				if record {
+					p.changedSeq = stateSeq
+				}
+			}
+			tmp2[securityId] = &p2
+		}
+		state.Positions[acc] = tmp2
+	}
+	for acc, name := range AccNames {
+		state.AccNames[acc] = name
+	}
+	for userId, accs := range UserIdAccs {
+		state.UserIdAccs[userId] = append([]int(nil), accs...)
+	}
+	for userId, portfolios := range UserPortfolios {
+		tmp := make(map[string]*Portfolio, len(portfolios))
+		for name, p := range portfolios {
+			tmp[name] = p
+		}
+		state.UserPortfolios[userId] = tmp
+	}
+	return state
+}
+
+// underlyings may come after their derivatives or from reference data, and
+// are subscribed so that their ticks mark the derivatives dirty
+func linkUnderlyings() {
+	for _, tmp := range Positions {
+		for _, p := range tmp {
+			u := p.Security.resolveUnderlying()
+			p.Security.underlying = u
+			if u != nil && !usedSecurities[u.Id] {
+				Request([]interface{}{"sub", u.Id})
+				usedSecurities[u.Id] = true
+			}
+		}
+	}
+}
+
+func isSecurityDirty(s *Security, dirty map[int64]bool) bool {
+	return dirty[s.Id] || (s.underlying != nil && dirty[s.underlying.Id])
+}
+
+func (p *Portfolio) hasWindow() bool {
+	for _, riskDef := range p.RiskDefs {
+		for _, rp := range riskDef.Params {
+			if rp.Window.Seconds > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether any position of p changed since last evaluation
+func (state *State) isDirty(p *Portfolio, accs []int) bool {
+	if state.AllDirty || (state.DirtyWindows && p.hasWindow()) || (state.DirtyFx && p.UsesFx) {
+		return true
+	}
+	for _, acc := range getAccMatch(p.AccPatterns, accs, state.AccNames) {
+		if state.DirtyAccs[acc] {
+			return true
+		}
+		if len(state.DirtySecurities) == 0 {
+			continue
+		}
+		for _, pos := range state.Positions[acc] {
+			if isSecurityDirty(pos.Security, state.DirtySecurities) {
+				return true
+			}
+		}
+	}
+	return false
+}
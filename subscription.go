@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// subscribed risk display names by portfolio name, "*" for all risks of the portfolio
+type Subscriptions map[string]map[string]bool
+
+// ["subscribe", portfolio, risk] or ["unsubscribe", portfolio, risk], risk is optional and means all
+// risks of the portfolio if omitted. Clients who never subscribe get everything.
+func (self *Client) Subscribe(msg []interface{}) {
+	action, _ := msg[0].(string)
+	var portfolio, risk string
+	if len(msg) > 1 {
+		portfolio, _ = msg[1].(string)
+	}
+	if len(msg) > 2 {
+		risk, _ = msg[2].(string)
+	}
+	if risk == "" {
+		risk = "*"
+	}
+	if self.Subs == nil {
+		self.Subs = make(Subscriptions)
+	}
+	if portfolio != "" {
+		risks := self.Subs[portfolio]
+		if action == "subscribe" {
+			if risks == nil {
+				risks = make(map[string]bool)
+				self.Subs[portfolio] = risks
+			}
+			risks[risk] = true
+		} else if risks != nil {
+			delete(risks, risk)
+			if risk == "*" || len(risks) == 0 {
+				delete(self.Subs, portfolio)
+			}
+		}
+	}
+	self.resetRisk()
+	MarkAllDirty()
+	if out, err := json.Marshal([]interface{}{"subscriptions", self.Subs}); err == nil {
+		self.Send(out)
+	}
+}
+
+func (self *Client) filterReport(rpt map[string]interface{}) map[string]interface{} {
+	if self.Subs == nil || rpt == nil {
+		return rpt
+	}
+	out := make(map[string]interface{})
+	for portfolio, risks := range self.Subs {
+		tmp, ok := rpt[portfolio].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if risks["*"] {
+			out[portfolio] = tmp
+			continue
+		}
+		tmp2 := make(map[string]interface{})
+		for risk := range risks {
+			if v, ok := tmp[risk]; ok {
+				tmp2[risk] = v
+			}
+		}
+		out[portfolio] = tmp2
+	}
+	return out
+}
+
+// union of the subscriptions of all logged in clients by user id, nil if any client of the user
+// takes everything, must be called on tradeServerJob goroutine
+func collectSubscriptions() map[int]Subscriptions {
+	out := make(map[int]Subscriptions)
+	all := make(map[int]bool)
+	clients.Range(func(_, c interface{}) bool {
+		client := c.(*Client)
+		userId := client.UserId()
+		if userId <= 0 || all[userId] {
+			return true
+		}
+		if client.Subs == nil {
+			all[userId] = true
+			out[userId] = nil
+			return true
+		}
+		subs := out[userId]
+		if subs == nil {
+			subs = make(Subscriptions)
+			out[userId] = subs
+		}
+		for portfolio, risks := range client.Subs {
+			tmp := subs[portfolio]
+			if tmp == nil {
+				tmp = make(map[string]bool)
+				subs[portfolio] = tmp
+			}
+			for risk := range risks {
+				tmp[risk] = true
+			}
+		}
+		return true
+	})
+	return out
+}
+
+// risks with bounds, graph or rolling windows keep running without subscribers, so that alerts fire
+// and history and windows have no holes
+func (self *RiskDef) alwaysRun() bool {
+	for _, rp := range self.Params {
+		if rp.HasBounds() || rp.Graph || rp.Window.Seconds > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// risks of p to evaluate, nil for all
+func (state *State) risksToRun(userId int, p *Portfolio) map[string]bool {
+	subs, ok := state.Subscriptions[userId]
+	if ok && subs == nil {
+		return nil
+	}
+	risks := subs[p.Name]
+	if risks["*"] {
+		return nil
+	}
+	out := make(map[string]bool)
+	for risk := range risks {
+		out[risk] = true
+	}
+	for _, riskDef := range p.RiskDefs {
+		if riskDef.alwaysRun() {
+			out[riskDef.DisplayName] = true
+		}
+	}
+	return out
+}
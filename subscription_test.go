@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRisksToRun(t *testing.T) {
+	cfg, err := ParseIni(`
+[gross]
+formula=sum(Pos*Close)
+[net]
+formula=sum(Pos*Close)
+upper_bound=100
+[trend]
+formula=sum(Pos*Close)
+graph=Y
+[pnl]
+formula=sum(Pos*Close)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio, err := ParsePortfolio(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portfolio.Name = "p1"
+	state := &State{Subscriptions: map[int]Subscriptions{
+		1: nil,
+		2: {"p1": {"gross": true}},
+		3: {"p1": {"*": true}},
+		4: {"p2": {"*": true}},
+	}}
+	tests := []struct {
+		userId int
+		want   map[string]bool
+	}{
+		{1, nil},
+		{2, map[string]bool{"gross": true, "net": true, "trend": true}},
+		{3, nil},
+		{4, map[string]bool{"net": true, "trend": true}},
+		// no clients logged in, bounds and graphs keep running
+		{5, map[string]bool{"net": true, "trend": true}},
+	}
+	for _, tt := range tests {
+		if got := state.risksToRun(tt.userId, portfolio); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("user %d: %v, want %v", tt.userId, got, tt.want)
+		}
+	}
+}
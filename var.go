@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var returnsDir = flag.String("returns", "returns", "directory of historical daily returns, one <Market>/<Symbol>.csv per security with date,return lines, dates in yyyy-mm-dd or yyyymmdd")
+
+type returnsEntry struct {
+	Series  map[string]float64 // date -> return
+	mtime   time.Time
+	checked time.Time
+}
+
+var returnsCache = make(map[string]*returnsEntry) // by market/symbol
+var returnsMutex sync.Mutex
+
+// yyyy-mm-dd or yyyymmdd normalized to yyyy-mm-dd, so that files in either
+// format line up and sort by date
+func normalizeDate(str string) (string, bool) {
+	str = strings.TrimSpace(str)
+	layout := "20060102"
+	if strings.Contains(str, "-") {
+		layout = "2006-01-02"
+	}
+	tm, err := time.Parse(layout, str)
+	if err != nil {
+		return "", false
+	}
+	return tm.Format("2006-01-02"), true
+}
+
+func loadReturns(fn string) map[string]float64 {
+	series := make(map[string]float64)
+	f, err := os.Open(fn)
+	if err != nil {
+		return series
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	records, _ := r.ReadAll()
+	invalid := 0
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+		// header or invalid line
+		v, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			continue
+		}
+		date, ok := normalizeDate(record[0])
+		if !ok {
+			invalid++
+			continue
+		}
+		series[date] = v
+	}
+	if invalid > 0 {
+		log.Println(invalid, "lines with invalid dates skipped in", fn)
+	}
+	return series
+}
+
+// of the security's market and symbol, reloaded if the file changed, checked
+// at most every refDataCheckInterval
+func getReturns(s *Security) map[string]float64 {
+	returnsMutex.Lock()
+	defer returnsMutex.Unlock()
+	now := time.Now()
+	key := path.Join(url.PathEscape(s.Market), url.PathEscape(s.Symbol))
+	entry := returnsCache[key]
+	if entry != nil && now.Sub(entry.checked) < refDataCheckInterval {
+		return entry.Series
+	}
+	fn := path.Join(*returnsDir, key+".csv")
+	mtime := modTime(fn)
+	if entry == nil || !mtime.Equal(entry.mtime) {
+		entry = &returnsEntry{Series: loadReturns(fn), mtime: mtime}
+		returnsCache[key] = entry
+	}
+	entry.checked = now
+	return entry.Series
+}
+
+// P&L of the positions' delta exposure over each of the last days dates
+// found in any of their returns, a position without a return on a date
+// contributing 0 to it
+func historicalPnls(positions []*Position, days int) []float64 {
+	exposures := make([]float64, 0, len(positions))
+	series := make([]map[string]float64, 0, len(positions))
+	dateSet := make(map[string]bool)
+	for _, p := range positions {
+		tmp := getReturns(p.Security)
+		if len(tmp) == 0 {
+			continue
+		}
+		exposures = append(exposures, p.DeltaExposure())
+		series = append(series, tmp)
+		for date := range tmp {
+			dateSet[date] = true
+		}
+	}
+	dates := make([]string, 0, len(dateSet))
+	for date := range dateSet {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	if len(dates) > days {
+		dates = dates[len(dates)-days:]
+	}
+	pnls := make([]float64, len(dates))
+	for i, date := range dates {
+		for j, exposure := range exposures {
+			if r, ok := series[j][date]; ok && exposure != 0 {
+				pnls[i] += exposure * r
+			}
+		}
+	}
+	return pnls
+}
+
+// loss not exceeded with the confidence in percent, and the mean loss beyond
+// it, both positive for losses
+func valueAtRisk(pnls []float64, confidence float64) (float64, float64) {
+	if len(pnls) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	tmp := append([]float64(nil), pnls...)
+	sort.Float64s(tmp)
+	n := int(math.Ceil(float64(len(tmp)) * (100 - confidence) / 100))
+	if n < 1 {
+		n = 1
+	}
+	return -tmp[n-1], -mean(tmp[:n])
+}
+
+// for A == "var" or "es"
+func historicalRisk(e *Expression, positions []*Position) float64 {
+	v, es := valueAtRisk(historicalPnls(positions, e.N), e.P)
+	if e.A == "es" {
+		return es
+	}
+	return v
+}
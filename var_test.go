@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestValueAtRisk(t *testing.T) {
+	pnls := []float64{4, -3, 10, 0, -5, 2, 12, -1, 8, 6}
+	tests := []struct {
+		pnls       []float64
+		confidence float64
+		wantVar    float64
+		wantEs     float64
+	}{
+		{pnls, 95, 5, 5},
+		{pnls, 80, 3, 4},
+		{pnls, 70, 1, 3},
+		{pnls, 100, 5, 5},
+		{[]float64{1, 2, 3}, 50, -2, -1.5},
+		{nil, 95, math.NaN(), math.NaN()},
+	}
+	for _, tt := range tests {
+		v, es := valueAtRisk(tt.pnls, tt.confidence)
+		if !floatEqual(v, tt.wantVar) || !floatEqual(es, tt.wantEs) {
+			t.Errorf("valueAtRisk(%v, %v) = %v, %v, want %v, %v", tt.pnls, tt.confidence, v, es, tt.wantVar, tt.wantEs)
+		}
+	}
+}
+
+func TestNormalizeDate(t *testing.T) {
+	tests := []struct {
+		str  string
+		want string
+		ok   bool
+	}{
+		{"2024-03-01", "2024-03-01", true},
+		{"20240301", "2024-03-01", true},
+		{" 20240301 ", "2024-03-01", true},
+		{"2024-3-1", "", false},
+		{"2024-02-30", "", false},
+		{"03/01/2024", "", false},
+		{"date", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeDate(tt.str)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizeDate(%q) = %q, %v, want %q, %v", tt.str, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHistoricalPnls(t *testing.T) {
+	dir := t.TempDir()
+	saved := *returnsDir
+	*returnsDir = dir
+	defer func() { *returnsDir = saved }()
+	// dates in either format line up, invalid ones are skipped
+	// the same symbol on another market has its own series
+	files := map[string]string{
+		"VT/VARTEST1":  "date,return\n2024-03-01,0.01\n2024-03-04,-0.02\n20240305,0.03\n2024-13-01,0.5\n",
+		"VT/VARTEST2":  "20240301,-0.01\n20240304,0.01\n",
+		"VT2/VARTEST2": "20240301,0.5\n20240304,0.5\n",
+	}
+	for fn, content := range files {
+		fn = path.Join(dir, fn+".csv")
+		if err := os.MkdirAll(path.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pos := func(symbol string, qty float64) *Position {
+		s := &Security{Symbol: symbol, Market: "VT", Multiplier: 1, Rate: 1}
+		s.Close = 100
+		p := &Position{Security: s}
+		p.Qty = qty
+		return p
+	}
+	// exposures 1000 and -2000
+	positions := []*Position{pos("VARTEST1", 10), pos("VARTEST2", -20)}
+	tests := []struct {
+		days int
+		want []float64
+	}{
+		{10, []float64{30, -40, 30}},
+		{2, []float64{-40, 30}},
+	}
+	for _, tt := range tests {
+		got := historicalPnls(positions, tt.days)
+		if len(got) != len(tt.want) {
+			t.Fatalf("historicalPnls(%d) = %v, want %v", tt.days, got, tt.want)
+		}
+		for i := range got {
+			if !floatEqual(got[i], tt.want[i]) {
+				t.Errorf("historicalPnls(%d) = %v, want %v", tt.days, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+)
+
+var windowTypes = []string{"change", "max", "min", "mean"}
+
+// fixed size ring buffer of (time, value), at most one sample per second
+type RingBuffer struct {
+	values [][2]float64
+	start  int
+	n      int
+}
+
+func newRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{values: make([][2]float64, size)}
+}
+
+func (self *RingBuffer) at(i int) *[2]float64 {
+	return &self.values[(self.start+i)%len(self.values)]
+}
+
+func (self *RingBuffer) Push(tm float64, v float64) {
+	if self.n > 0 {
+		last := self.at(self.n - 1)
+		if tm-last[0] < 1 {
+			last[1] = v
+			return
+		}
+	}
+	if self.n < len(self.values) {
+		*self.at(self.n) = [2]float64{tm, v}
+		self.n++
+		return
+	}
+	self.values[self.start] = [2]float64{tm, v}
+	self.start = (self.start + 1) % len(self.values)
+}
+
+func (self *RingBuffer) Aggregate(typ string, since float64) float64 {
+	res := math.NaN()
+	first := math.NaN()
+	last := math.NaN()
+	total := 0.
+	n := 0
+	for i := 0; i < self.n; i++ {
+		tmp := self.at(i)
+		if tmp[0] < since || math.IsNaN(tmp[1]) {
+			continue
+		}
+		v := tmp[1]
+		if n == 0 {
+			first = v
+		}
+		last = v
+		total += v
+		n++
+		switch typ {
+		case "max":
+			if math.IsNaN(res) || v > res {
+				res = v
+			}
+		case "min":
+			if math.IsNaN(res) || v < res {
+				res = v
+			}
+		}
+	}
+	switch typ {
+	case "change":
+		res = last - first
+	case "mean":
+		if n > 0 {
+			res = total / float64(n)
+		}
+	}
+	return res
+}
+
+func (self *RiskParamDef) applyWindow(key string, now float64, v float64) float64 {
+	buf := self.Windows[key]
+	if buf == nil {
+		buf = newRingBuffer(self.Window.Seconds + 1)
+		self.Windows[key] = buf
+	}
+	buf.Push(now, v)
+	return buf.Aggregate(self.Window.Type, now-float64(self.Window.Seconds))
+}
+
+// window value as if v was pushed, without touching the buffer
+func (self *RiskParamDef) peekWindow(key string, now float64, v float64) float64 {
+	buf := newRingBuffer(self.Window.Seconds + 1)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if tmp := self.Windows[key]; tmp != nil {
+		*buf = *tmp
+		buf.values = append([][2]float64(nil), tmp.values...)
+	}
+	buf.Push(now, v)
+	return buf.Aggregate(self.Window.Type, now-float64(self.Window.Seconds))
+}
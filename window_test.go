@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRingBufferAggregate(t *testing.T) {
+	// size 4, the first sample is evicted by the fifth, the sample at 2.5
+	// replaces the one at 2 being within a second
+	samples := [][2]float64{{0, 5}, {1, 3}, {2, 8}, {2.5, 6}, {3, math.NaN()}, {4, 2}}
+	tests := []struct {
+		typ   string
+		since float64
+		want  float64
+	}{
+		{"change", 0, -1},
+		{"max", 0, 6},
+		{"min", 0, 2},
+		{"mean", 0, 11. / 3},
+		{"change", 2, -4},
+		{"max", 3, 2},
+		{"mean", 5, math.NaN()},
+		{"change", 5, math.NaN()},
+	}
+	buf := newRingBuffer(4)
+	for _, s := range samples {
+		buf.Push(s[0], s[1])
+	}
+	for _, tt := range tests {
+		got := buf.Aggregate(tt.typ, tt.since)
+		if !floatEqual(got, tt.want) {
+			t.Errorf("%s since %v = %v, want %v", tt.typ, tt.since, got, tt.want)
+		}
+	}
+}
+
+func TestApplyWindow(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want []float64
+	}{
+		{"change", []float64{0, 10, 25, 0, -35}},
+		{"max", []float64{100, 110, 125, 125, 125}},
+		{"min", []float64{100, 100, 100, 110, 90}},
+		{"mean", []float64{100, 105, 335. / 3, 345. / 3, 325. / 3}},
+	}
+	values := []float64{100, 110, 125, 110, 90}
+	for _, tt := range tests {
+		rp := &RiskParamDef{Window: WindowDef{Seconds: 2, Type: tt.typ}, Windows: make(map[string]*RingBuffer)}
+		for i, v := range values {
+			peek := rp.peekWindow("g", float64(i), v)
+			got := rp.applyWindow("g", float64(i), v)
+			if !floatEqual(got, tt.want[i]) || !floatEqual(peek, got) {
+				t.Errorf("%s at %d = %v (peek %v), want %v", tt.typ, i, got, peek, tt.want[i])
+			}
+		}
+	}
+}
+
+func floatEqual(a float64, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}